@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// adminAction is an action that the admin API asks coord to perform.
+type adminAction int
+
+const (
+	// adminSave saves the session immediately.
+	adminSave adminAction = iota
+
+	// adminReset discards the statistics in the session without
+	// archiving them.
+	adminReset
+
+	// adminReload reloads the config file given by -config.
+	adminReload
+
+	// adminEvict stops tracking a character that's stuck online,
+	// usually because its logout was missed.
+	adminEvict
+
+	// adminRefresh queues the profiles of a character, or of every
+	// character named in the session, to be refreshed.
+	adminRefresh
+
+	// adminQueues reports the depths of the tracker's internal queues.
+	adminQueues
+)
+
+// adminRequest is a request for coord to perform an admin action. id
+// is the character that it applies to, if any. The result is sent to
+// res.
+type adminRequest struct {
+	action adminAction
+	id     int64
+	res    chan<- adminResult
+}
+
+// adminResult is the result of an admin action. v is sent back to the
+// client as JSON.
+type adminResult struct {
+	v   interface{}
+	err error
+}
+
+// admin is used to ask coord to perform admin actions. See adminDo.
+var admin = make(chan adminRequest)
+
+// adminDo asks coord to perform an action and waits for the result.
+func adminDo(action adminAction, id int64) (interface{}, error) {
+	res := make(chan adminResult)
+	admin <- adminRequest{action: action, id: id, res: res}
+
+	r := <-res
+	return r.v, r.err
+}
+
+// notOnlineError is returned when an action applies to a character
+// that isn't online.
+type notOnlineError int64
+
+func (err notOnlineError) Error() string {
+	return fmt.Sprintf("Character %v is not online", int64(err))
+}
+
+// A pendinger is a DB that buffers changes before writing them, such
+// as writeBehindDB.
+type pendinger interface {
+	Pending() int
+}
+
+// queueDepth is the depth of one of the tracker's internal queues.
+// Cap is left out for queues without a fixed capacity.
+type queueDepth struct {
+	Len int `json:"len"`
+	Cap int `json:"cap,omitempty"`
+}
+
+// adminSettings is the JSON form of settings.
+type adminSettings struct {
+	Short     string `json:"short"`
+	Warmup    string `json:"warmup"`
+	Uncertain bool   `json:"uncertain"`
+	NoOutages bool   `json:"nooutages"`
+}
+
+func newAdminSettings(s settings) adminSettings {
+	return adminSettings{
+		Short:     s.Short.String(),
+		Warmup:    s.Warmup.String(),
+		Uncertain: s.Uncertain,
+		NoOutages: s.NoOutages,
+	}
+}
+
+// adminPost checks that req is a POST request. If it isn't, an error
+// is sent and false is returned.
+func adminPost(rw http.ResponseWriter, req *http.Request) bool {
+	if req.Method != "POST" {
+		rw.Header().Set("Allow", "POST")
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+
+	return true
+}
+
+// adminID parses the character ID given by the id parameter of req. If
+// it's invalid, or it's missing and required is true, an error is sent
+// and false is returned.
+func adminID(rw http.ResponseWriter, req *http.Request, required bool) (int64, bool) {
+	v := req.FormValue("id")
+	if v == "" {
+		if required {
+			http.Error(rw, "A character ID must be given with id", http.StatusBadRequest)
+			return 0, false
+		}
+
+		return 0, true
+	}
+
+	id, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Invalid character ID: %q", v), http.StatusBadRequest)
+		return 0, false
+	}
+
+	return id, true
+}
+
+// adminRun asks coord to perform action and sends the result to rw as
+// JSON.
+func adminRun(rw http.ResponseWriter, action adminAction, id int64) {
+	v, err := adminDo(action, id)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if _, ok := err.(notOnlineError); ok {
+			status = http.StatusNotFound
+		}
+
+		log.Printf("Admin action failed: %v", err)
+		http.Error(rw, err.Error(), status)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+
+	e := json.NewEncoder(rw)
+	err = e.Encode(v)
+	if err != nil {
+		log.Printf("Failed to write admin result: %v", err)
+	}
+}
+
+// serveAdminSave saves the session immediately.
+func serveAdminSave(rw http.ResponseWriter, req *http.Request) {
+	if !adminPost(rw, req) {
+		return
+	}
+
+	adminRun(rw, adminSave, 0)
+}
+
+// serveAdminReset discards the statistics in the session. As this
+// can't be undone, the request must have confirm=true.
+func serveAdminReset(rw http.ResponseWriter, req *http.Request) {
+	if !adminPost(rw, req) {
+		return
+	}
+
+	if ok, _ := strconv.ParseBool(req.FormValue("confirm")); !ok {
+		http.Error(rw, "Resetting statistics can't be undone. Send confirm=true to do it anyway.", http.StatusBadRequest)
+		return
+	}
+
+	adminRun(rw, adminReset, 0)
+}
+
+// serveAdminReload reloads the config file.
+func serveAdminReload(rw http.ResponseWriter, req *http.Request) {
+	if !adminPost(rw, req) {
+		return
+	}
+
+	adminRun(rw, adminReload, 0)
+}
+
+// serveAdminEvict stops tracking the character given by id.
+func serveAdminEvict(rw http.ResponseWriter, req *http.Request) {
+	if !adminPost(rw, req) {
+		return
+	}
+
+	id, ok := adminID(rw, req, true)
+	if !ok {
+		return
+	}
+
+	adminRun(rw, adminEvict, id)
+}
+
+// serveAdminRefresh queues profiles to be refreshed, either of the
+// character given by id or, if there isn't one, of every character
+// named in the session.
+func serveAdminRefresh(rw http.ResponseWriter, req *http.Request) {
+	if !adminPost(rw, req) {
+		return
+	}
+
+	id, ok := adminID(rw, req, false)
+	if !ok {
+		return
+	}
+
+	adminRun(rw, adminRefresh, id)
+}
+
+// serveAdminQueues serves the depths of the internal queues.
+func serveAdminQueues(rw http.ResponseWriter, req *http.Request) {
+	if (req.Method != "GET") && (req.Method != "HEAD") {
+		rw.Header().Set("Allow", "GET, HEAD")
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	adminRun(rw, adminQueues, 0)
+}
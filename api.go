@@ -1,10 +1,10 @@
 package main
 
 import (
-	"bytes"
 	"github.com/DeedleFake/census"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -17,6 +17,9 @@ var (
 	}
 )
 
+// getName returns the display name of a character, including its
+// outfit's alias if it has one. If the name can't be found, the ID is
+// returned instead, along with the error.
 func getName(id int64) (name string, err error) {
 	defer func() {
 		if err != nil {
@@ -24,37 +27,117 @@ func getName(id int64) (name string, err error) {
 		}
 	}()
 
+	p, err := getProfile(id)
+	if err != nil {
+		return "", err
+	}
+
+	return p.DisplayName(), nil
+}
+
+// getProfile returns the profile of a character, using the profile
+// cache if it's been created.
+func getProfile(id int64) (Profile, error) {
+	if profiles != nil {
+		return profiles.Get(id)
+	}
+
+	return fetchProfile(id)
+}
+
+// getProfiles returns the profiles of several characters, using the
+// profile cache if it's been created. Characters that don't exist are
+// left out of the returned map.
+func getProfiles(ids []int64) (map[int64]Profile, error) {
+	if profiles != nil {
+		return profiles.GetMany(ids)
+	}
+
+	return fetchProfiles(ids)
+}
+
+// fetchProfile looks up a character's profile in Census.
+func fetchProfile(id int64) (Profile, error) {
+	ps, err := fetchProfiles([]int64{id})
+	if err != nil {
+		return Profile{}, err
+	}
+
+	p, ok := ps[id]
+	if !ok {
+		return Profile{}, noSuchCharError(id)
+	}
+
+	return p, nil
+}
+
+// fetchProfiles looks up the profiles of several characters in Census
+// with a single request. Characters that don't exist are left out of
+// the returned map.
+func fetchProfiles(ids []int64) (map[int64]Profile, error) {
+	start := time.Now()
+	defer func() {
+		metricCensusLatency.Observe(time.Since(start).Seconds())
+	}()
+
 	var data struct {
 		Chars []struct {
-			Name struct {
+			CharacterID string `json:"character_id"`
+			Name        struct {
 				First string
 			}
+			FactionID  string `json:"faction_id"`
+			WorldID    string `json:"world_id"`
+			BattleRank struct {
+				Value string
+			} `json:"battle_rank"`
 			Outfit struct {
-				Alias string
+				OutfitID string `json:"outfit_id"`
+				Alias    string
 			}
 		} `json:"character_list"`
 	}
-	err = client.Get(&data,
+
+	list := make([]string, 0, len(ids))
+	for _, id := range ids {
+		list = append(list, strconv.FormatInt(id, 10))
+	}
+
+	err := client.Get(&data,
 		"character",
-		census.SearchOption("character_id", strconv.FormatInt(id, 10)),
-		census.ResolveOption("outfit"),
+		census.SearchOption("character_id", strings.Join(list, ",")),
+		census.SearchOption("c:limit", strconv.Itoa(len(ids))),
+		census.ResolveOption("outfit,world"),
 	)
 	if err != nil {
-		return "", err
-	}
-	if len(data.Chars) == 0 {
-		return "", noSuchCharError(id)
+		return nil, err
 	}
 
-	buf := bytes.NewBuffer(make([]byte, 0, len(data.Chars[0].Name.First)+len(data.Chars[0].Outfit.Alias)+3))
-	if data.Chars[0].Outfit.Alias != "" {
-		buf.WriteByte('[')
-		buf.WriteString(data.Chars[0].Outfit.Alias)
-		buf.WriteString("] ")
+	ps := make(map[int64]Profile, len(data.Chars))
+	for _, c := range data.Chars {
+		id, err := strconv.ParseInt(c.CharacterID, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		p := Profile{
+			ID:          id,
+			Name:        c.Name.First,
+			OutfitAlias: c.Outfit.Alias,
+		}
+
+		// Census returns numbers as strings, and leaves out fields that
+		// don't apply, such as the outfit of a character not in one, so
+		// fields that can't be parsed are just left as zero.
+		p.OutfitID, _ = strconv.ParseInt(c.Outfit.OutfitID, 10, 64)
+		p.Faction, _ = strconv.ParseInt(c.FactionID, 10, 64)
+		p.World, _ = strconv.ParseInt(c.WorldID, 10, 64)
+		p.BattleRank, _ = strconv.Atoi(c.BattleRank.Value)
+
+		ps[id] = p
 	}
-	buf.WriteString(data.Chars[0].Name.First)
 
-	return buf.String(), nil
+	return ps, nil
 }
 
 type noSuchCharError int64
@@ -62,3 +145,24 @@ type noSuchCharError int64
 func (err noSuchCharError) Error() string {
 	return "No such char: " + strconv.FormatInt(int64(err), 10)
 }
+
+// worlds maps world IDs to their names.
+var worlds = map[int64]string{
+	1:  "Connery",
+	10: "Miller",
+	13: "Cobalt",
+	17: "Emerald",
+	19: "Jaeger",
+	25: "Briggs",
+	40: "SolTech",
+}
+
+// worldName returns the name of the world with the given ID, or the
+// ID itself if the world is unknown.
+func worldName(id int64) string {
+	if name, ok := worlds[id]; ok {
+		return name
+	}
+
+	return strconv.FormatInt(id, 10)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// archiveVersion is the version of the archive format written by
+// exportArchive. Version 1 archives didn't have profiles.
+const archiveVersion = 2
+
+// An archive is a backend-independent copy of everything stored in a
+// DB.
+type archive struct {
+	Version  int       `json:"version"`
+	Exported time.Time `json:"exported"`
+
+	// Session is the session as encoded by marshalSession, so that it
+	// carries its own version.
+	Session json.RawMessage `json:"session,omitempty"`
+
+	Chars     []archivedChar `json:"chars"`
+	Records   []Record       `json:"records"`
+	Rollups   []Rollup       `json:"rollups"`
+	Epochs    []Epoch        `json:"epochs"`
+	Intervals []Interval     `json:"intervals"`
+
+	// Outages are oldest first.
+	Outages []Outage `json:"outages"`
+
+	Profiles []Profile `json:"profiles"`
+}
+
+// archivedChar is a tracked character in an archive.
+type archivedChar struct {
+	ID    int64     `json:"id"`
+	Login time.Time `json:"login"`
+}
+
+// An importer is a DB that can import an archive in a single
+// transaction, so that a failed import leaves it unchanged. s is the
+// session from the archive, if it has one.
+type importer interface {
+	Import(a *archive, s *Session) error
+}
+
+// exportArchive writes everything in db to w as an archive.
+func exportArchive(w io.Writer, db DB) error {
+	a := archive{
+		Version:  archiveVersion,
+		Exported: time.Now(),
+	}
+
+	s, err := db.LoadSession()
+	switch err {
+	case nil:
+		a.Session, err = marshalSession(s)
+		if err != nil {
+			return err
+		}
+	case errNoSession:
+	default:
+		return fmt.Errorf("Failed to load session: %v", err)
+	}
+
+	err = db.EachChar(func(id int64, login time.Time) error {
+		a.Chars = append(a.Chars, archivedChar{ID: id, Login: login})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to get characters: %v", err)
+	}
+
+	err = db.EachRecord(func(r Record) error {
+		a.Records = append(a.Records, r)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to get records: %v", err)
+	}
+
+	err = db.EachRollup(func(r Rollup) error {
+		a.Rollups = append(a.Rollups, r)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to get rollups: %v", err)
+	}
+
+	a.Epochs, err = db.Epochs()
+	if err != nil {
+		return fmt.Errorf("Failed to get epochs: %v", err)
+	}
+
+	a.Intervals, err = db.Intervals()
+	if err != nil {
+		return fmt.Errorf("Failed to get coverage: %v", err)
+	}
+
+	a.Outages, err = db.Outages(math.MaxInt32)
+	if err != nil {
+		return fmt.Errorf("Failed to get outages: %v", err)
+	}
+	for i, j := 0, len(a.Outages)-1; i < j; i, j = i+1, j-1 {
+		a.Outages[i], a.Outages[j] = a.Outages[j], a.Outages[i]
+	}
+
+	err = db.EachProfile(func(p Profile) error {
+		a.Profiles = append(a.Profiles, p)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to get profiles: %v", err)
+	}
+
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	return e.Encode(a)
+}
+
+// importArchive reads an archive from r and adds everything in it to
+// db, replacing the session. Characters are added to the ones already
+// in db, although the tracker clears them when it starts, as they may
+// have logged out since the archive was exported. db can't have any records, rollups,
+// epochs, coverage, or outages yet, as they would be counted twice. If
+// db is an importer, the archive is imported in a single transaction.
+func importArchive(r io.Reader, db DB) error {
+	var a archive
+	d := json.NewDecoder(r)
+	err := d.Decode(&a)
+	if err != nil {
+		return err
+	}
+	if a.Version > archiveVersion {
+		return fmt.Errorf("Archive version %v is newer than the latest known version %v", a.Version, archiveVersion)
+	}
+
+	var s *Session
+	if a.Session != nil {
+		as, err := unmarshalSession(a.Session)
+		if err != nil {
+			return fmt.Errorf("Failed to decode session: %v", err)
+		}
+		s = &as
+	}
+
+	err = checkEmpty(db)
+	if err != nil {
+		return err
+	}
+
+	if i, ok := db.(importer); ok {
+		return i.Import(&a, s)
+	}
+
+	if s != nil {
+		err = db.SaveSession(*s)
+		if err != nil {
+			return fmt.Errorf("Failed to save session: %v", err)
+		}
+	}
+
+	for _, c := range a.Chars {
+		err = db.SetChar(c.ID, c.Login)
+		if err != nil {
+			return fmt.Errorf("Failed to add character %v: %v", c.ID, err)
+		}
+	}
+
+	for _, r := range a.Records {
+		err = db.AddRecord(r)
+		if err != nil {
+			return fmt.Errorf("Failed to add record: %v", err)
+		}
+	}
+
+	for _, r := range a.Rollups {
+		err = db.MergeRollup(r)
+		if err != nil {
+			return fmt.Errorf("Failed to add rollup: %v", err)
+		}
+	}
+
+	for _, epoch := range a.Epochs {
+		err = db.SaveEpoch(epoch)
+		if err != nil {
+			return fmt.Errorf("Failed to add epoch %q: %v", epoch.Label, err)
+		}
+	}
+
+	for _, i := range a.Intervals {
+		err = db.SaveInterval(i)
+		if err != nil {
+			return fmt.Errorf("Failed to add coverage: %v", err)
+		}
+	}
+
+	for _, o := range a.Outages {
+		err = db.AddOutage(o)
+		if err != nil {
+			return fmt.Errorf("Failed to add outage: %v", err)
+		}
+	}
+
+	for _, p := range a.Profiles {
+		err = db.SaveProfile(p)
+		if err != nil {
+			return fmt.Errorf("Failed to add profile of %v: %v", p.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// checkEmpty returns an error if db has any records, rollups, epochs,
+// coverage, or outages.
+func checkEmpty(db DB) error {
+	records, err := db.RecordsAfter(time.Time{}, 0, 1)
+	if err != nil {
+		return fmt.Errorf("Failed to get records: %v", err)
+	}
+
+	rollups, err := db.RollupsAfter("", 0, 1)
+	if err != nil {
+		return fmt.Errorf("Failed to get rollups: %v", err)
+	}
+
+	epochs, err := db.Epochs()
+	if err != nil {
+		return fmt.Errorf("Failed to get epochs: %v", err)
+	}
+
+	intervals, err := db.Intervals()
+	if err != nil {
+		return fmt.Errorf("Failed to get coverage: %v", err)
+	}
+
+	outages, err := db.Outages(1)
+	if err != nil {
+		return fmt.Errorf("Failed to get outages: %v", err)
+	}
+
+	if len(records)+len(rollups)+len(epochs)+len(intervals)+len(outages) > 0 {
+		return errors.New("The database already has records, rollups, epochs, coverage, or outages in it. Archives can only be imported into a new database, so that nothing is counted twice.")
+	}
+
+	return nil
+}
+
+func cmdExport(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Expected at most one argument, got %v", len(args))
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if (len(args) == 0) || (args[0] == "-") {
+		return exportArchive(os.Stdout, db)
+	}
+
+	file, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = exportArchive(file, db)
+	if err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+func cmdImport(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Expected at most one argument, got %v", len(args))
+	}
+
+	var r io.Reader = os.Stdin
+	if (len(args) == 1) && (args[0] != "-") {
+		file, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		r = file
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return importArchive(r, db)
+}
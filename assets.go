@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"time"
+)
+
+// assets holds the web interface's HTML, CSS, and JavaScript, so that
+// the binary doesn't depend on anything else to serve it.
+//
+//go:embed assets
+var assets embed.FS
+
+// embeddedAssets returns the assets that are embedded in the binary.
+func embeddedAssets() fs.FS {
+	sub, err := fs.Sub(assets, "assets")
+	if err != nil {
+		// The directory is embedded at build time, so this can't
+		// happen.
+		panic(err)
+	}
+
+	return sub
+}
+
+// assetFS returns the file system that the web interface is served
+// from. If the -assets flag was given, files in that directory are
+// used in place of the embedded ones with the same names.
+func assetFS() fs.FS {
+	if flags.assets == "" {
+		return embeddedAssets()
+	}
+
+	return overlayFS{os.DirFS(flags.assets), embeddedAssets()}
+}
+
+// overlayFS is a stack of file systems. Files are opened from the
+// first file system in the stack that has them.
+type overlayFS []fs.FS
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	for _, fsys := range o {
+		file, err := fsys.Open(name)
+		if err == nil {
+			return file, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// serveRoot returns a handler that serves index with index for the
+// root of the site and assets for everything else.
+func serveRoot(index http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/", "/index.html":
+			index.ServeHTTP(rw, req)
+		default:
+			serveAsset(rw, req)
+		}
+	})
+}
+
+// serveAsset serves a file from assetFS. Embedded assets can only
+// change when the binary does, so they're allowed to be cached for a
+// while. Assets from disk have to be revalidated every time. Templates
+// aren't served, as their source isn't meant to be seen as is.
+func serveAsset(rw http.ResponseWriter, req *http.Request) {
+	name := path.Clean(req.URL.Path)[1:]
+	if isTemplate(name) {
+		http.NotFound(rw, req)
+		return
+	}
+
+	fsys := assetFS()
+
+	if fi, err := fs.Stat(fsys, name); (err == nil) && fi.IsDir() {
+		http.NotFound(rw, req)
+		return
+	}
+
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid) {
+			http.NotFound(rw, req)
+			return
+		}
+
+		log.Printf("Failed to read asset %q: %v", name, err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		rw.Header().Set("Content-Type", ctype)
+	}
+
+	sum := sha256.Sum256(data)
+	rw.Header().Set("ETag", `"`+hex.EncodeToString(sum[:8])+`"`)
+
+	if flags.assets == "" {
+		rw.Header().Set("Cache-Control", "public, max-age=3600")
+	} else {
+		rw.Header().Set("Cache-Control", "no-cache")
+	}
+
+	http.ServeContent(rw, req, name, time.Time{}, bytes.NewReader(data))
+}
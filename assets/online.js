@@ -0,0 +1,125 @@
+(function() {
+	function $(selector)
+	{
+		return document.querySelector(selector);
+	}
+
+	function show(el)
+	{
+		el.style.display = 'block';
+	}
+
+	function hide(el)
+	{
+		el.style.display = 'none';
+	}
+
+	function getJSON(url)
+	{
+		return fetch(url).then(function(rsp) {
+			if (!rsp.ok)
+			{
+				throw new Error(rsp.statusText);
+			}
+
+			return rsp.json();
+		});
+	}
+
+	// formatElapsed formats a number of seconds as hours and minutes.
+	function formatElapsed(seconds)
+	{
+		var minutes = Math.floor(seconds / 60);
+		var hours = Math.floor(minutes / 60);
+		if (hours == 0)
+		{
+			return minutes + 'm';
+		}
+
+		return hours + 'h ' + (minutes % 60) + 'm';
+	}
+
+	var pageSize = 50;
+
+	var params = new URLSearchParams(location.search);
+	var state = {
+		"sort": params.get('sort') == 'newest' ? 'newest' : 'longest',
+		"offset": Math.max(0, parseInt(params.get('offset'), 10) || 0),
+	};
+
+	var error = $('#error');
+	var total = $('#total');
+	var rows = $('#online tbody');
+	var range = $('#range');
+	var prev = $('#prev');
+	var next = $('#next');
+
+	function row(rank, c)
+	{
+		var tr = document.createElement('tr');
+		[
+			rank,
+			c.name || c.id,
+			c.outfit_alias ? '[' + c.outfit_alias + ']' : '',
+			c.world_name || 'Unknown',
+			formatElapsed(c.elapsed.seconds),
+			new Date(c.login).toLocaleString(),
+		].forEach(function(text) {
+			var td = document.createElement('td');
+			td.textContent = text;
+			tr.appendChild(td);
+		});
+
+		return tr;
+	}
+
+	// timer is the pending refresh, if any.
+	var timer = null;
+
+	function load()
+	{
+		clearTimeout(timer);
+		timer = setTimeout(load, 30000);
+
+		history.replaceState(null, '', '?sort=' + state.sort + '&offset=' + state.offset);
+
+		var url = 'api/v1/characters/online?sort=' + state.sort + '&offset=' + state.offset + '&limit=' + pageSize;
+		getJSON(url).then(function(page) {
+			hide(error);
+
+			total.textContent = page.total;
+			rows.textContent = '';
+			page.items.forEach(function(c, i) {
+				rows.appendChild(row(page.offset + i + 1, c));
+			});
+
+			var end = page.offset + page.items.length;
+			range.textContent = page.items.length == 0 ? '' : (page.offset + 1) + ' - ' + end + ' of ' + page.total;
+			prev.disabled = page.offset == 0;
+			next.disabled = end >= page.total;
+		}).catch(function() {
+			error.textContent = 'Error connecting to ps2avglogin server.';
+			show(error);
+		});
+	}
+
+	document.querySelectorAll('[data-sort]').forEach(function(a) {
+		a.addEventListener('click', function(ev) {
+			ev.preventDefault();
+			state.sort = a.dataset.sort;
+			state.offset = 0;
+			load();
+		});
+	});
+
+	prev.addEventListener('click', function() {
+		state.offset = Math.max(0, state.offset - pageSize);
+		load();
+	});
+	next.addEventListener('click', function() {
+		state.offset += pageSize;
+		load();
+	});
+
+	load();
+})();
@@ -0,0 +1,240 @@
+(function() {
+	function $(selector)
+	{
+		return document.querySelector(selector);
+	}
+
+	function show(el)
+	{
+		el.style.display = 'block';
+	}
+
+	function hide(el)
+	{
+		el.style.display = 'none';
+	}
+
+	function getJSON(url)
+	{
+		return fetch(url).then(function(rsp) {
+			if (!rsp.ok)
+			{
+				throw new Error(rsp.statusText);
+			}
+
+			return rsp.json();
+		});
+	}
+
+	var loading = $('#loading');
+	var main = $('#main');
+
+	var noshort = {
+		"average": $('#noshort .average'),
+		"num": $('#noshort .num'),
+	};
+	var total = {
+		"average": $('#total .average'),
+		"num": $('#total .num'),
+	};
+	var uncertain = {
+		"average": $('#uncertain .average'),
+		"num": $('#uncertain .num'),
+	};
+
+	var longest = $('#longest');
+	var longestname = $('#longestname');
+	var shortestlong = $('#shortestlong');
+	var shortest = $('#shortest');
+
+	var oldest = $('#oldest');
+	var oldestname = $('#oldestname');
+
+	var online = $('#online');
+	var runtime = $('#runtime');
+	var coverage = $('#coverage');
+	var gapsessions = $('#gapsessions');
+	var recovered = {
+		"main": $('#recovered'),
+		"backup": $('#recovered .backup'),
+	};
+
+	var error = $('#error');
+
+	var survival = {
+		"median": $('#survival .median'),
+		"completed": $('#survival .completed'),
+		"active": $('#survival .active'),
+	};
+
+	var outages = {
+		"main": $('#outages'),
+		"list": $('#outages ul'),
+		"sessions": $('#outages .sessions'),
+		"num": $('#outages .num'),
+	};
+
+	var epochs = $('#epochs');
+	var epochrows = $('#epochs tbody');
+
+	function showError(msg)
+	{
+		error.textContent = msg;
+		show(error);
+	}
+
+	function setFields(data)
+	{
+		hide(loading);
+		show(main);
+
+		noshort.average.textContent = data.noshort.cur;
+		noshort.num.textContent = data.noshort.num;
+		total.average.textContent = data.total.cur;
+		total.num.textContent = data.total.num;
+		uncertain.average.textContent = data.uncertain.cur;
+		uncertain.num.textContent = data.uncertain.num;
+
+		longest.textContent = data.longest;
+		longestname.textContent = '(' + data.longestname + ')';
+		shortestlong.textContent = data.shortestlong;
+		shortest.textContent = data.shortest;
+
+		oldest.textContent = data.oldest;
+		oldestname.textContent = '(' + data.oldestname + ')';
+
+		online.textContent = data.numchars;
+		runtime.textContent = data.runtime;
+		coverage.textContent = data.coverage.toFixed(2);
+		outages.sessions.textContent = data.outagesessions;
+		outages.num.textContent = data.outages;
+		gapsessions.textContent = data.gapsessions;
+		if (data.recovered != undefined)
+		{
+			recovered.backup.textContent = data.recovered;
+			show(recovered.main);
+		}
+
+		if (data.err != undefined)
+		{
+			showError('Error fetching data from Census API: ' + data.err);
+		}
+		else
+		{
+			hide(error);
+		}
+	}
+
+	// live is true while the session is being pushed by the server,
+	// in which case it doesn't need to be polled.
+	var live = false;
+
+	function getSession()
+	{
+		getJSON('session').then(setFields).catch(function() {
+			showError('Error connecting to ps2avglogin server.');
+		});
+	}
+
+	function getSurvival()
+	{
+		getJSON('survival').then(function(data) {
+			survival.median.textContent = data.median == null ? 'Unknown' : data.median;
+			survival.completed.textContent = data.completed;
+			survival.active.textContent = data.active;
+		}).catch(function() {});
+	}
+
+	function getOutages()
+	{
+		getJSON('outages').then(function(data) {
+			outages.list.textContent = '';
+			if ((data == null) || (data.length == 0))
+			{
+				hide(outages.main);
+				return;
+			}
+
+			data.forEach(function(outage) {
+				var li = document.createElement('li');
+				li.textContent = outage.worldname + ': ' + outage.logouts + ' logouts from ' + outage.start + ' to ' + outage.end;
+				outages.list.appendChild(li);
+			});
+
+			show(outages.main);
+		}).catch(function() {});
+	}
+
+	function epochRow(label, epoch)
+	{
+		var row = document.createElement('tr');
+		[
+			label,
+			epoch.start + ' - ' + epoch.end,
+			epoch.session.total.cur,
+			epoch.session.noshort.cur,
+			epoch.session.total.num,
+			epoch.session.longest + ' (' + epoch.session.longestname + ')',
+		].forEach(function(text) {
+			var td = document.createElement('td');
+			td.textContent = text;
+			row.appendChild(td);
+		});
+
+		return row;
+	}
+
+	function getEpochs()
+	{
+		getJSON('epochs').then(function(data) {
+			epochrows.textContent = '';
+			if ((data.epochs == null) || (data.epochs.length == 0))
+			{
+				hide(epochs);
+				return;
+			}
+
+			data.epochs.forEach(function(epoch) {
+				epochrows.appendChild(epochRow(epoch.label, epoch));
+			});
+			epochrows.appendChild(epochRow('Current', data.current));
+
+			show(epochs);
+		}).catch(function() {});
+	}
+
+	function poll()
+	{
+		if (!live)
+		{
+			getSession();
+		}
+		getEpochs();
+		getSurvival();
+		getOutages();
+
+		setTimeout(poll, 30000);
+	}
+
+	function listen()
+	{
+		if (window.EventSource == undefined)
+		{
+			return;
+		}
+
+		var source = new EventSource('live');
+		source.addEventListener('session', function(ev) {
+			live = true;
+			setFields(JSON.parse(ev.data));
+		});
+		source.addEventListener('error', function() {
+			// The browser reconnects on its own unless the source is
+			// closed. Fall back to polling until it does.
+			live = false;
+		});
+	}
+
+	listen();
+	poll();
+})();
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	sqlite3 "github.com/mattn/go-sqlite3"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A backuper is a DB that can write a consistent snapshot of itself
+// to a file while it's in use.
+type backuper interface {
+	// Backup writes a snapshot of the database to the file at path,
+	// replacing it if it exists.
+	Backup(path string) error
+}
+
+// sqliteBackup uses SQLite's online backup API to copy the main
+// database of src to a new database at path. Writes to src can keep
+// happening while the copy is made, and the copy is still consistent.
+func sqliteBackup(src *sql.DB, path string) error {
+	dest, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	ctx := context.Background()
+
+	sc, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+
+	dc, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+
+	return dc.Raw(func(dconn interface{}) error {
+		return sc.Raw(func(sconn interface{}) error {
+			d, ok := dconn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("Unexpected connection type %T", dconn)
+			}
+			s, ok := sconn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("Unexpected connection type %T", sconn)
+			}
+
+			b, err := d.Backup("main", s, "main")
+			if err != nil {
+				return err
+			}
+
+			// A negative step copies every page at once.
+			_, err = b.Step(-1)
+			if err != nil {
+				b.Finish()
+				return err
+			}
+
+			return b.Finish()
+		})
+	})
+}
+
+func (db *sqliteDB) Backup(path string) error {
+	return sqliteBackup(db.DB, path)
+}
+
+func (wb *writeBehindDB) Backup(path string) error {
+	err := wb.Flush()
+	if err != nil {
+		return err
+	}
+
+	return wb.sqliteDB.Backup(path)
+}
+
+// writeBackup backs db up to the file at path. If gz is true, the
+// file is gzipped. The snapshot is written next to path first, so
+// path is never left partially written.
+func writeBackup(db backuper, path string, gz bool) (err error) {
+	tmp := path + ".tmp"
+	defer os.Remove(tmp)
+
+	err = db.Backup(tmp)
+	if err != nil {
+		return err
+	}
+
+	if !gz {
+		return os.Rename(tmp, path)
+	}
+
+	in, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	gztmp := path + ".gz.tmp"
+	out, err := os.Create(gztmp)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(gztmp)
+		}
+	}()
+
+	w := gzip.NewWriter(out)
+	_, err = io.Copy(w, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	err = w.Close()
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	err = out.Sync()
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(gztmp, path)
+}
+
+// backupPrefix is the start of the names of the backups made in the
+// directory given by the -backup flag.
+const backupPrefix = "session."
+
+// backupResult is the result of making a single backup.
+type backupResult struct {
+	Path     string       `json:"path"`
+	Size     int64        `json:"size"`
+	Start    time.Time    `json:"start"`
+	Duration jsonDuration `json:"duration"`
+
+	// Removed is the old backups that were removed to stay within the
+	// configured number of backups to keep.
+	Removed []string `json:"removed"`
+}
+
+// backupOptions returns the options given by the -backup flag.
+func backupOptions() (dir string, keep int, gz bool, err error) {
+	dir = flags.backup["dir"]
+
+	keep, err = strconv.Atoi(flags.backup["keep"])
+	if err != nil {
+		return "", 0, false, fmt.Errorf("Bad keep option: %v", err)
+	}
+
+	if g := flags.backup["gzip"]; g != "" {
+		gz, err = strconv.ParseBool(g)
+		if err != nil {
+			return "", 0, false, fmt.Errorf("Bad gzip option: %v", err)
+		}
+	}
+
+	return dir, keep, gz, nil
+}
+
+// runBackup makes a new timestamped backup of db in the directory
+// given by the -backup flag, and then removes old backups from it.
+func runBackup(db backuper) (res backupResult, err error) {
+	dir, keep, gz, err := backupOptions()
+	if err != nil {
+		return res, err
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return res, err
+	}
+
+	res.Start = time.Now()
+	name := backupPrefix + res.Start.UTC().Format(backupTimeFormat) + ".db"
+	if gz {
+		name += ".gz"
+	}
+	res.Path = filepath.Join(dir, name)
+
+	log.Printf("Backing up database to %q...", res.Path)
+	err = writeBackup(db, res.Path, gz)
+	if err != nil {
+		return res, err
+	}
+	res.Duration = jsonDuration(time.Since(res.Start))
+
+	if fi, err := os.Stat(res.Path); err == nil {
+		res.Size = fi.Size()
+	}
+
+	res.Removed, err = pruneBackups(dir, keep)
+	return res, err
+}
+
+// pruneBackups removes all but the newest keep backups from dir,
+// returning the paths of the ones that were removed. If keep is 0 or
+// less, nothing is removed.
+func pruneBackups(dir string, keep int) ([]string, error) {
+	if keep <= 0 {
+		return nil, nil
+	}
+
+	matches, err := filepath.Glob(filepath.Join(dir, backupPrefix+"*.db*"))
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []string
+	for _, m := range matches {
+		ts := strings.TrimPrefix(filepath.Base(m), backupPrefix)
+		ts = strings.TrimSuffix(strings.TrimSuffix(ts, ".gz"), ".db")
+		if _, err := time.Parse(backupTimeFormat, ts); err == nil {
+			backups = append(backups, m)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+
+	var removed []string
+	for len(backups) > keep {
+		old := backups[len(backups)-1]
+		err = os.Remove(old)
+		if err != nil {
+			return removed, err
+		}
+
+		removed = append(removed, old)
+		backups = backups[:len(backups)-1]
+	}
+
+	return removed, nil
+}
+
+// scheduleBackups backs up db periodically, as configured by the
+// -backup flag, until ctx is canceled.
+func scheduleBackups(ctx context.Context, db DB) {
+	v := flags.backup["every"]
+	if v == "" {
+		return
+	}
+	every, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("Bad backup interval: %v", err)
+		return
+	}
+
+	b, ok := db.(backuper)
+	if !ok {
+		log.Printf("The %q DB doesn't support backups.", flags.db["type"])
+		return
+	}
+
+	log.Printf("Backing up database every %v.", every)
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			res, err := runBackup(b)
+			if err != nil {
+				log.Printf("Backup failed: %v", err)
+				continue
+			}
+			log.Printf("Backed up %v bytes to %q.", res.Size, res.Path)
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// serveBackup returns a handler that backs up db when it receives a
+// POST request, and serves the result as JSON.
+func serveBackup(db DB) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			rw.Header().Set("Allow", "POST")
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		b, ok := db.(backuper)
+		if !ok {
+			http.Error(rw, fmt.Sprintf("The %q DB doesn't support backups", flags.db["type"]), http.StatusNotImplemented)
+			return
+		}
+
+		res, err := runBackup(b)
+		if err != nil {
+			log.Printf("Backup failed: %v", err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		e := json.NewEncoder(rw)
+		err = e.Encode(res)
+		if err != nil {
+			log.Printf("Failed to write backup result: %v", err)
+		}
+	})
+}
+
+func cmdBackup(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Expected at most one argument, got %v", len(args))
+	}
+
+	switch flags.db["type"] {
+	case "sqlite", "sqlite3":
+	default:
+		return fmt.Errorf("Backups are only supported by the sqlite DB")
+	}
+	if flags.db["db"] == "" {
+		flags.db["db"] = "session.db"
+	}
+
+	// The database is opened directly, rather than with createDB, so
+	// that nothing in it is changed while the tracker is running.
+	db, err := sql.Open("sqlite3", flags.db["db"])
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	b := &sqliteDB{DB: db}
+
+	if len(args) == 1 {
+		return writeBackup(b, args[0], strings.HasSuffix(args[0], ".gz"))
+	}
+
+	res, err := runBackup(b)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Backed up %v bytes to %q.\n", res.Size, res.Path)
+	for _, old := range res.Removed {
+		fmt.Printf("Removed old backup %q.\n", old)
+	}
+
+	return nil
+}
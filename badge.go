@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// badgeCacheTime is how long the statistics shown on badges and the
+// widget are reused before they're fetched from coord again. It's also
+// how long clients are allowed to cache them for.
+const badgeCacheTime = time.Minute
+
+// badgeStats are the statistics shown on badges and the widget.
+type badgeStats struct {
+	Average     time.Duration
+	Sessions    int64
+	Median      time.Duration
+	Online      int
+	Longest     time.Duration
+	LongestName string
+	Updated     time.Time
+}
+
+// badgeCache caches the statistics shown on badges so that hot-linked
+// badges don't make a request to coord each.
+var badgeCache struct {
+	sync.Mutex
+	stats badgeStats
+	when  time.Time
+}
+
+// getBadgeStats returns the statistics shown on badges, getting them
+// again if the cached ones are too old. If the median can't be
+// estimated, it's left as zero.
+func getBadgeStats(db DB) badgeStats {
+	badgeCache.Lock()
+	defer badgeCache.Unlock()
+
+	if !badgeCache.when.IsZero() && (time.Since(badgeCache.when) < badgeCacheTime) {
+		return badgeCache.stats
+	}
+
+	s := <-session
+	stats := badgeStats{
+		Average:     time.Duration(s.NoShort.Cur),
+		Sessions:    s.NoShort.Num,
+		Online:      s.NumChars,
+		Longest:     time.Duration(s.Longest),
+		LongestName: s.LongestName,
+		Updated:     time.Now(),
+	}
+
+	sv, err := getSurvival(db)
+	if err != nil {
+		log.Printf("Failed to estimate survival curve for badges: %v", err)
+	}
+	if (sv != nil) && (sv.Median != nil) {
+		stats.Median = time.Duration(*sv.Median)
+	}
+
+	badgeCache.stats = stats
+	badgeCache.when = stats.Updated
+
+	return stats
+}
+
+// formatBadgeDuration formats d to the minute, such as 1h23m, or as
+// unknown if it's zero.
+func formatBadgeDuration(d time.Duration) string {
+	if d <= 0 {
+		return "unknown"
+	}
+
+	d = d.Round(time.Minute)
+	h, m := int64(d/time.Hour), int64(d%time.Hour/time.Minute)
+	if h == 0 {
+		return fmt.Sprintf("%vm", m)
+	}
+
+	return fmt.Sprintf("%vh%02dm", h, m)
+}
+
+// A badge is the label and default message color of a single badge.
+// value returns its message.
+type badge struct {
+	label string
+	color string
+	value func(badgeStats) string
+}
+
+// badges are the badges served under /badge/, by file name.
+var badges = map[string]badge{
+	"average.svg": {
+		label: "avg session",
+		color: "#007ec6",
+		value: func(s badgeStats) string { return formatBadgeDuration(s.Average) },
+	},
+	"median.svg": {
+		label: "median session",
+		color: "#007ec6",
+		value: func(s badgeStats) string { return formatBadgeDuration(s.Median) },
+	},
+	"online.svg": {
+		label: "online",
+		color: "#4c1",
+		value: func(s badgeStats) string { return strconv.Itoa(s.Online) },
+	},
+	"longest.svg": {
+		label: "longest session",
+		color: "#fe7d37",
+		value: func(s badgeStats) string { return formatBadgeDuration(s.Longest) },
+	},
+}
+
+// badgeColor matches the colors that can be given with the color
+// parameter, which are hex colors without the leading #.
+var badgeColor = regexp.MustCompile(`^([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// badgeTextWidth estimates the width in pixels of text in 11px
+// Verdana, which is close enough to size a badge to fit it.
+func badgeTextWidth(text string) int {
+	var w int
+	for _, c := range text {
+		switch {
+		case strings.ContainsRune("iljtf.,:;!|' ", c):
+			w += 4
+		case strings.ContainsRune("mwMW", c):
+			w += 11
+		case (c >= 'A') && (c <= 'Z'):
+			w += 8
+		default:
+			w += 7
+		}
+	}
+
+	return w
+}
+
+// badgeSVG renders a flat badge in the style of shields.io.
+func badgeSVG(label, message, color string) string {
+	lw := badgeTextWidth(label) + 10
+	mw := badgeTextWidth(message) + 10
+	w := lw + mw
+
+	label, message, color = html.EscapeString(label), html.EscapeString(message), html.EscapeString(color)
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%v" height="20" role="img" aria-label="%v: %v">`, w, label, message)
+	fmt.Fprintf(&buf, `<title>%v: %v</title>`, label, message)
+	buf.WriteString(`<linearGradient id="s" x2="0" y2="100%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>`)
+	fmt.Fprintf(&buf, `<clipPath id="r"><rect width="%v" height="20" rx="3" fill="#fff"/></clipPath>`, w)
+	fmt.Fprintf(&buf, `<g clip-path="url(#r)"><rect width="%v" height="20" fill="#555"/><rect x="%v" width="%v" height="20" fill="%v"/><rect width="%v" height="20" fill="url(#s)"/></g>`, lw, lw, mw, color, w)
+	buf.WriteString(`<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">`)
+	for _, t := range []struct {
+		x    float64
+		text string
+	}{
+		{float64(lw) / 2, label},
+		{float64(lw) + float64(mw)/2, message},
+	} {
+		fmt.Fprintf(&buf, `<text x="%v" y="15" fill="#010101" fill-opacity=".3">%v</text><text x="%v" y="14">%v</text>`, t.x, t.text, t.x, t.text)
+	}
+	buf.WriteString(`</g></svg>`)
+
+	return buf.String()
+}
+
+// embedHeaders sets the headers that allow badges and the widget to
+// be used from other sites and cached for a short while.
+func embedHeaders(rw http.ResponseWriter) {
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	rw.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+	rw.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%v", int(badgeCacheTime.Seconds())))
+}
+
+// embedMethod checks that req is a request that badges and the widget
+// can answer. Preflight requests are answered here, in which case, as
+// for requests with other methods, false is returned.
+func embedMethod(rw http.ResponseWriter, req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD":
+		return true
+
+	case "OPTIONS":
+		rw.WriteHeader(http.StatusNoContent)
+		return false
+
+	default:
+		rw.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+}
+
+// serveBadge returns a handler that serves the badges under /badge/.
+// The label can be replaced with the label parameter and the color of
+// the message with the color parameter.
+func serveBadge(db DB) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		embedHeaders(rw)
+		if !embedMethod(rw, req) {
+			return
+		}
+
+		b, ok := badges[strings.TrimPrefix(req.URL.Path, "/badge/")]
+		if !ok {
+			http.NotFound(rw, req)
+			return
+		}
+
+		label := b.label
+		if v := req.FormValue("label"); v != "" {
+			label = v
+		}
+
+		color := b.color
+		if v := req.FormValue("color"); v != "" {
+			if !badgeColor.MatchString(v) {
+				http.Error(rw, fmt.Sprintf("Invalid color: %q", v), http.StatusBadRequest)
+				return
+			}
+			color = "#" + v
+		}
+
+		rw.Header().Set("Content-Type", "image/svg+xml; charset=utf-8")
+		_, err := fmt.Fprint(rw, badgeSVG(label, b.value(getBadgeStats(db)), color))
+		if err != nil {
+			log.Printf("Failed to write badge: %v", err)
+		}
+	})
+}
+
+// serveWidget returns a handler that serves a small page with the
+// main statistics that's meant to be embedded in other sites with an
+// iframe.
+func serveWidget(db DB) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		embedHeaders(rw)
+		if !embedMethod(rw, req) {
+			return
+		}
+
+		tmpl, err := templates()
+		if err != nil {
+			log.Printf("Failed to load templates: %v", err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		stats := getBadgeStats(db)
+
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = tmpl.ExecuteTemplate(rw, "widget", map[string]interface{}{
+			"Req":     req,
+			"Title":   "PS2 Average Login Times",
+			"Refresh": int(badgeCacheTime.Seconds()),
+			"Stats":   stats,
+			"Average": formatBadgeDuration(stats.Average),
+			"Median":  formatBadgeDuration(stats.Median),
+			"Longest": formatBadgeDuration(stats.Longest),
+		})
+		if err != nil {
+			log.Printf("Failed to execute %q: %v", "widget", err)
+		}
+	})
+}
@@ -0,0 +1,735 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"time"
+)
+
+// Buckets used by boltDB.
+var (
+	// boltChars maps character IDs to login times.
+	boltChars = []byte("chars")
+
+	// boltLogins indexes characters by login time. Its keys are a
+	// login time followed by a character ID, and its values are empty.
+	boltLogins = []byte("logins")
+
+	// boltRecords maps a logout time followed by a character ID to a
+	// record.
+	boltRecords = []byte("records")
+
+	boltSession  = []byte("session")
+	boltEpochs   = []byte("epochs")
+	boltCoverage = []byte("coverage")
+	boltOutages  = []byte("outages")
+
+	// boltRollups maps a day followed by a world ID to a rollup.
+	boltRollups = []byte("rollups")
+
+	// boltProfiles maps character IDs to cached profiles.
+	boltProfiles = []byte("profiles")
+
+	// boltMeta holds counters that are kept up to date along with the
+	// buckets that they count, as counting them would be slow.
+	boltMeta = []byte("meta")
+)
+
+// boltSessionKey is the key that the session is stored under in the
+// session bucket.
+var boltSessionKey = []byte("session")
+
+// boltNumCharsKey is the key in the meta bucket of the number of
+// characters in the chars bucket.
+var boltNumCharsKey = []byte("numchars")
+
+// boltDB is a DB that stores everything in an embedded bbolt
+// database. Unlike sqliteDB, it doesn't require cgo.
+type boltDB struct {
+	*bolt.DB
+}
+
+func newboltDB(path string) (DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltChars, boltLogins, boltRecords, boltSession, boltEpochs, boltCoverage, boltOutages, boltRollups, boltProfiles, boltMeta} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Databases from before the count was kept have to be counted
+		// once.
+		meta := tx.Bucket(boltMeta)
+		if meta.Get(boltNumCharsKey) == nil {
+			n := tx.Bucket(boltChars).Stats().KeyN
+			err := meta.Put(boltNumCharsKey, boltID(int64(n)))
+			if err != nil {
+				return err
+			}
+		}
+
+		return rekeyBoltRecords(tx)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltDB{DB: db}, nil
+}
+
+// boltID encodes an integer as a bolt key. Keys are big endian so
+// that they sort numerically.
+func boltID(id int64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(id))
+	return buf
+}
+
+// boltTime encodes t as a bolt key.
+func boltTime(t time.Time) []byte {
+	return boltID(t.UnixNano())
+}
+
+// boltLoginKey returns the key for a character in the login index.
+func boltLoginKey(id int64, login time.Time) []byte {
+	return append(boltTime(login), boltID(id)...)
+}
+
+// boltRecordKey returns the key for a record, which orders records in
+// the way that RecordsAfter expects.
+func boltRecordKey(r Record) []byte {
+	return append(boltTime(r.Logout), boltID(r.CharID)...)
+}
+
+// rekeyBoltRecords moves records that are keyed by sequence number,
+// as they were before they could be read in order of logout time, to
+// the keys given by boltRecordKey.
+func rekeyBoltRecords(tx *bolt.Tx) error {
+	b := tx.Bucket(boltRecords)
+
+	var old [][]byte
+	var records []Record
+	err := b.ForEach(func(k, v []byte) error {
+		if len(k) != 8 {
+			return nil
+		}
+
+		var r Record
+		err := json.Unmarshal(v, &r)
+		if err != nil {
+			return err
+		}
+
+		old = append(old, k)
+		records = append(records, r)
+		return nil
+	})
+	if (err != nil) || (len(old) == 0) {
+		return err
+	}
+
+	log.Printf("Rekeying %v records...", len(old))
+	for i, k := range old {
+		err := b.Delete(k)
+		if err != nil {
+			return err
+		}
+
+		err = boltPut(tx, boltRecords, boltRecordKey(records[i]), records[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func parseBoltID(buf []byte) int64 {
+	return int64(binary.BigEndian.Uint64(buf))
+}
+
+func parseBoltTime(buf []byte) time.Time {
+	return time.Unix(0, parseBoltID(buf))
+}
+
+// put stores the JSON encoding of v in bucket under the next sequence
+// number.
+func (db *boltDB) put(bucket []byte, v interface{}) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return boltAppend(tx, bucket, v)
+	})
+}
+
+// boltAppend stores the JSON encoding of v in bucket under the next
+// sequence number as part of tx.
+func boltAppend(tx *bolt.Tx, bucket []byte, v interface{}) error {
+	b := tx.Bucket(bucket)
+
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	return boltPut(tx, bucket, boltID(int64(seq)), v)
+}
+
+// boltPut stores the JSON encoding of v in bucket under key as part of
+// tx.
+func boltPut(tx *bolt.Tx, bucket, key []byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(bucket).Put(key, data)
+}
+
+// boltAddNumChars adds delta to the number of characters as part of
+// tx.
+func boltAddNumChars(tx *bolt.Tx, delta int64) error {
+	meta := tx.Bucket(boltMeta)
+
+	var n int64
+	if v := meta.Get(boltNumCharsKey); v != nil {
+		n = parseBoltID(v)
+	}
+
+	return meta.Put(boltNumCharsKey, boltID(n+delta))
+}
+
+// boltSetChar sets the login time of a character as part of tx.
+func boltSetChar(tx *bolt.Tx, id int64, login time.Time) error {
+	chars := tx.Bucket(boltChars)
+	logins := tx.Bucket(boltLogins)
+
+	if old := chars.Get(boltID(id)); old != nil {
+		err := logins.Delete(boltLoginKey(id, parseBoltTime(old)))
+		if err != nil {
+			return err
+		}
+	} else {
+		err := boltAddNumChars(tx, 1)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := chars.Put(boltID(id), boltTime(login))
+	if err != nil {
+		return err
+	}
+
+	return logins.Put(boltLoginKey(id, login), nil)
+}
+
+func (db *boltDB) SetChar(id int64, login time.Time) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return boltSetChar(tx, id, login)
+	})
+}
+
+func (db *boltDB) GetChar(id int64) (login time.Time, ok bool, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltChars).Get(boltID(id))
+		if v == nil {
+			return nil
+		}
+
+		login, ok = parseBoltTime(v), true
+		return nil
+	})
+	return
+}
+
+func (db *boltDB) OldestChar() (id int64, login time.Time, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		k, _ := tx.Bucket(boltLogins).Cursor().First()
+		if k == nil {
+			return nil
+		}
+
+		login, id = parseBoltTime(k[:8]), parseBoltID(k[8:])
+		return nil
+	})
+	return
+}
+
+func (db *boltDB) RemoveChar(id int64) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		chars := tx.Bucket(boltChars)
+
+		old := chars.Get(boltID(id))
+		if old == nil {
+			return nil
+		}
+
+		err := tx.Bucket(boltLogins).Delete(boltLoginKey(id, parseBoltTime(old)))
+		if err != nil {
+			return err
+		}
+
+		err = boltAddNumChars(tx, -1)
+		if err != nil {
+			return err
+		}
+
+		return chars.Delete(boltID(id))
+	})
+}
+
+func (db *boltDB) ClearChars() error {
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltChars, boltLogins} {
+			err := tx.DeleteBucket(name)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket(boltMeta).Put(boltNumCharsKey, boltID(0))
+	})
+}
+
+func (db *boltDB) NumChar() (n int) {
+	err := db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(boltMeta).Get(boltNumCharsKey); v != nil {
+			n = int(parseBoltID(v))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to get number of active characters: %v", err)
+	}
+
+	return n
+}
+
+func (db *boltDB) EachChar(f func(int64, time.Time) error) error {
+	return db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltChars).ForEach(func(k, v []byte) error {
+			return f(parseBoltID(k), parseBoltTime(v))
+		})
+	})
+}
+
+func (db *boltDB) EachCharByLogin(newest bool, f func(int64, time.Time) error) error {
+	return db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltLogins).Cursor()
+
+		first, next := c.First, c.Next
+		if newest {
+			first, next = c.Last, c.Prev
+		}
+
+		for k, _ := first(); k != nil; k, _ = next() {
+			err := f(parseBoltID(k[8:]), parseBoltTime(k[:8]))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (db *boltDB) AddRecord(r Record) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx, boltRecords, boltRecordKey(r), r)
+	})
+}
+
+func (db *boltDB) EachRecord(f func(Record) error) error {
+	return db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRecords).ForEach(func(k, v []byte) error {
+			var r Record
+			err := json.Unmarshal(v, &r)
+			if err != nil {
+				return err
+			}
+
+			return f(r)
+		})
+	})
+}
+
+func (db *boltDB) RecordsAfter(logout time.Time, id int64, n int) (page []Record, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltRecords).Cursor()
+
+		k, v := c.First()
+		if !logout.IsZero() {
+			after := boltRecordKey(Record{CharID: id, Logout: logout})
+			k, v = c.Seek(after)
+			if bytes.Equal(k, after) {
+				k, v = c.Next()
+			}
+		}
+
+		for ; (k != nil) && (len(page) < n); k, v = c.Next() {
+			var r Record
+			err := json.Unmarshal(v, &r)
+			if err != nil {
+				return err
+			}
+
+			page = append(page, r)
+		}
+
+		return nil
+	})
+	return page, err
+}
+
+func (db *boltDB) PruneRecords(before time.Time) (n int, err error) {
+	err = db.Update(func(tx *bolt.Tx) error {
+		rs := make(rollups)
+
+		records := tx.Bucket(boltRecords)
+		var old [][]byte
+		err := records.ForEach(func(k, v []byte) error {
+			var r Record
+			err := json.Unmarshal(v, &r)
+			if err != nil {
+				return err
+			}
+
+			if r.Logout.Before(before) {
+				rs.Add(r)
+				old = append(old, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range old {
+			err = records.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		n = len(old)
+
+		for _, ru := range rs {
+			err = boltMergeRollup(tx, *ru)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	return n, err
+}
+
+// boltMergeRollup merges r into the matching rollup in the database
+// as part of tx.
+func boltMergeRollup(tx *bolt.Tx, r Rollup) error {
+	b := tx.Bucket(boltRollups)
+
+	key := append([]byte(r.Day), boltID(r.World)...)
+	if old := b.Get(key); old != nil {
+		var o Rollup
+		err := json.Unmarshal(old, &o)
+		if err != nil {
+			return err
+		}
+		r.Merge(o)
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(key, data)
+}
+
+func (db *boltDB) MergeRollup(r Rollup) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return boltMergeRollup(tx, r)
+	})
+}
+
+func (db *boltDB) EachRollup(f func(Rollup) error) error {
+	return db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRollups).ForEach(func(k, v []byte) error {
+			var r Rollup
+			err := json.Unmarshal(v, &r)
+			if err != nil {
+				return err
+			}
+
+			return f(r)
+		})
+	})
+}
+
+func (db *boltDB) RollupsAfter(day string, world int64, n int) (page []Rollup, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltRollups).Cursor()
+
+		after := append([]byte(day), boltID(world)...)
+		k, v := c.Seek(after)
+		if bytes.Equal(k, after) {
+			k, v = c.Next()
+		}
+
+		for ; (k != nil) && (len(page) < n); k, v = c.Next() {
+			var r Rollup
+			err := json.Unmarshal(v, &r)
+			if err != nil {
+				return err
+			}
+
+			page = append(page, r)
+		}
+
+		return nil
+	})
+	return page, err
+}
+
+func (db *boltDB) LoadSession() (s Session, err error) {
+	defer func() {
+		s.db = db
+	}()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltSession).Get(boltSessionKey)
+		if data == nil {
+			return errNoSession
+		}
+
+		s, err = unmarshalSession(data)
+		return err
+	})
+	return s, err
+}
+
+func (db *boltDB) SaveSession(s Session) error {
+	data, err := marshalSession(s)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSession).Put(boltSessionKey, data)
+	})
+}
+
+func (db *boltDB) SaveEpoch(epoch Epoch) error {
+	return db.put(boltEpochs, epoch)
+}
+
+func (db *boltDB) Epochs() (epochs []Epoch, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltEpochs).ForEach(func(k, v []byte) error {
+			var epoch Epoch
+			err := json.Unmarshal(v, &epoch)
+			if err != nil {
+				return err
+			}
+
+			epochs = append(epochs, epoch)
+			return nil
+		})
+	})
+	return
+}
+
+func (db *boltDB) SaveInterval(i Interval) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx, boltCoverage, boltTime(i.Start), i)
+	})
+}
+
+func (db *boltDB) Intervals() (intervals []Interval, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltCoverage).ForEach(func(k, v []byte) error {
+			var i Interval
+			err := json.Unmarshal(v, &i)
+			if err != nil {
+				return err
+			}
+
+			intervals = append(intervals, i)
+			return nil
+		})
+	})
+	return
+}
+
+func (db *boltDB) AddOutage(o Outage) error {
+	return db.put(boltOutages, o)
+}
+
+func (db *boltDB) Outages(n int) (outages []Outage, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltOutages).Cursor()
+		for k, v := c.Last(); (k != nil) && (len(outages) < n); k, v = c.Prev() {
+			var o Outage
+			err := json.Unmarshal(v, &o)
+			if err != nil {
+				return err
+			}
+
+			outages = append(outages, o)
+		}
+
+		return nil
+	})
+	return
+}
+
+func (db *boltDB) PruneOutages(before time.Time) (n int, err error) {
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltOutages)
+
+		var old [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var o Outage
+			err := json.Unmarshal(v, &o)
+			if err != nil {
+				return err
+			}
+
+			if o.End.Before(before) {
+				old = append(old, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range old {
+			err = b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+
+		n = len(old)
+		return nil
+	})
+	return n, err
+}
+
+func (db *boltDB) GetProfile(id int64) (p Profile, ok bool, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltProfiles).Get(boltID(id))
+		if v == nil {
+			return nil
+		}
+
+		ok = true
+		return json.Unmarshal(v, &p)
+	})
+	return
+}
+
+func (db *boltDB) SaveProfile(p Profile) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx, boltProfiles, boltID(p.ID), p)
+	})
+}
+
+func (db *boltDB) EachProfile(f func(Profile) error) error {
+	return db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltProfiles).ForEach(func(k, v []byte) error {
+			var p Profile
+			err := json.Unmarshal(v, &p)
+			if err != nil {
+				return err
+			}
+
+			return f(p)
+		})
+	})
+}
+
+// Import imports an archive in a single transaction.
+func (db *boltDB) Import(a *archive, s *Session) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		if s != nil {
+			data, err := marshalSession(*s)
+			if err != nil {
+				return err
+			}
+
+			err = tx.Bucket(boltSession).Put(boltSessionKey, data)
+			if err != nil {
+				return fmt.Errorf("Failed to save session: %v", err)
+			}
+		}
+
+		for _, c := range a.Chars {
+			err := boltSetChar(tx, c.ID, c.Login)
+			if err != nil {
+				return fmt.Errorf("Failed to add character %v: %v", c.ID, err)
+			}
+		}
+
+		for _, r := range a.Records {
+			err := boltPut(tx, boltRecords, boltRecordKey(r), r)
+			if err != nil {
+				return fmt.Errorf("Failed to add record: %v", err)
+			}
+		}
+
+		for _, r := range a.Rollups {
+			err := boltMergeRollup(tx, r)
+			if err != nil {
+				return fmt.Errorf("Failed to add rollup: %v", err)
+			}
+		}
+
+		for _, epoch := range a.Epochs {
+			err := boltAppend(tx, boltEpochs, epoch)
+			if err != nil {
+				return fmt.Errorf("Failed to add epoch %q: %v", epoch.Label, err)
+			}
+		}
+
+		for _, i := range a.Intervals {
+			err := boltPut(tx, boltCoverage, boltTime(i.Start), i)
+			if err != nil {
+				return fmt.Errorf("Failed to add coverage: %v", err)
+			}
+		}
+
+		for _, o := range a.Outages {
+			err := boltAppend(tx, boltOutages, o)
+			if err != nil {
+				return fmt.Errorf("Failed to add outage: %v", err)
+			}
+		}
+
+		for _, p := range a.Profiles {
+			err := boltPut(tx, boltProfiles, boltID(p.ID), p)
+			if err != nil {
+				return fmt.Errorf("Failed to add profile of %v: %v", p.ID, err)
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// A command is a subcommand that can be run instead of the tracker
+// itself. Commands run against the database directly, so the tracker
+// should not be running at the same time unless a command says
+// otherwise.
+type command struct {
+	// args describes the command's arguments for the usage message.
+	args string
+
+	// desc is a short description of the command.
+	desc string
+
+	// run runs the command. It is given the arguments that followed
+	// the command's name.
+	run func(args []string) error
+}
+
+// commands maps command names to commands. It is filled in by init to
+// avoid an initialization loop with usage.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"backup": {
+			args: "[file]",
+			desc: "Back up the sqlite database while the tracker is running. Writes a new backup to the directory given by -backup if no file is given. Files ending in .gz are gzipped.",
+			run:  cmdBackup,
+		},
+		"epoch": {
+			args: "<label>",
+			desc: "Archive the current session as an epoch and start a new one. If the tracker is running at -addr, it's asked to do it through /admin/epoch with the credentials given by -admin or -adminuser.",
+			run:  cmdEpoch,
+		},
+		"epochs": {
+			desc: "List archived epochs.",
+			run:  cmdEpochs,
+		},
+		"export": {
+			args: "[file]",
+			desc: "Export everything in the database to a JSON archive. Writes to stdout if no file is given.",
+			run:  cmdExport,
+		},
+		"import": {
+			args: "[file]",
+			desc: "Import a JSON archive made by export into a new database, replacing the session. Reads from stdin if no file is given.",
+			run:  cmdImport,
+		},
+		"migrate": {
+			args: "[version | latest]",
+			desc: "Show the schema version of the sqlite database, or migrate it up to the given version. Downgrades aren't supported.",
+			run:  cmdMigrate,
+		},
+	}
+
+	flag.Usage = usage
+}
+
+// usage prints the usage message, including the available commands.
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %v [options] [command [arguments]]\n\n", os.Args[0])
+
+	fmt.Fprintln(os.Stderr, "Commands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(os.Stderr, 0, 8, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "  %v %v\t%v\n", name, commands[name].args, commands[name].desc)
+	}
+	tw.Flush()
+
+	fmt.Fprintln(os.Stderr, "\nOptions:")
+	flag.PrintDefaults()
+}
+
+// runCommand runs the command named by args[0] with the rest of args
+// as its arguments.
+func runCommand(args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("Unknown command. Run with -help for a list of commands.")
+	}
+
+	return cmd.run(args[1:])
+}
+
+func cmdEpoch(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Expected exactly one argument, got %v", len(args))
+	}
+
+	// A running tracker would overwrite the new session with its own
+	// the next time that it saved, so it has to start the epoch itself.
+	// The database is only changed directly if nothing is listening.
+	err := postEpoch(args[0])
+	if err == nil {
+		fmt.Println("Started a new epoch in the running tracker.")
+		return nil
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	s, err := db.LoadSession()
+	if err != nil {
+		return fmt.Errorf("Failed to load session: %v", err)
+	}
+	initSession(&s)
+
+	s, err = archiveSession(db, s, args[0])
+	if err != nil {
+		return err
+	}
+
+	return s.Save()
+}
+
+// trackerURL returns the URL of path on the web interface of a tracker
+// running at the address given by -addr.
+func trackerURL(path string) (string, error) {
+	host, port, err := net.SplitHostPort(flags.addr)
+	if err != nil {
+		return "", fmt.Errorf("Bad address %q: %v", flags.addr, err)
+	}
+	if (host == "") || net.ParseIP(host).IsUnspecified() {
+		host = "localhost"
+	}
+
+	return "http://" + net.JoinHostPort(host, port) + path, nil
+}
+
+// postEpoch asks the tracker running at the address given by -addr to
+// archive its session under label through the admin API. If it isn't
+// running, the returned error wraps syscall.ECONNREFUSED.
+func postEpoch(label string) error {
+	u, err := trackerURL("/admin/epoch")
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", u, strings.NewReader(url.Values{"label": {label}}.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	switch {
+	case flags.admin != "":
+		req.Header.Set("Authorization", "Bearer "+flags.admin)
+	case flags.adminuser != "":
+		userpass := strings.SplitN(flags.adminuser, ":", 2)
+		if len(userpass) != 2 {
+			return fmt.Errorf("Bad -adminuser: expected user:password")
+		}
+		req.SetBasicAuth(userpass[0], userpass[1])
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 1024))
+		return fmt.Errorf("The tracker at %v failed to start a new epoch: %v: %v", u, rsp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
+
+func cmdEpochs(args []string) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	epochs, err := db.Epochs()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer tw.Flush()
+
+	fmt.Fprintln(tw, "LABEL\tSTART\tEND\tAVERAGE\tNO SHORT\tSESSIONS")
+	for _, epoch := range epochs {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\n",
+			epoch.Label,
+			epoch.Start.Format(time.RFC3339),
+			epoch.End.Format(time.RFC3339),
+			time.Duration(epoch.Session.Total.Cur),
+			time.Duration(epoch.Session.NoShort.Cur),
+			epoch.Session.Total.Num,
+		)
+	}
+
+	return nil
+}
+
+func cmdMigrate(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Expected at most one argument, got %v", len(args))
+	}
+
+	switch flags.db["type"] {
+	case "sqlite", "sqlite3":
+	default:
+		return fmt.Errorf("Migrations are only supported by the sqlite DB")
+	}
+	if flags.db["db"] == "" {
+		flags.db["db"] = "session.db"
+	}
+
+	db, err := sql.Open("sqlite3", flags.db["db"])
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if len(args) == 1 {
+		to := len(sqliteMigrations)
+		if args[0] != "latest" {
+			to, err = strconv.Atoi(args[0])
+			if err != nil {
+				return err
+			}
+		}
+
+		err = migrateSqlite(db, to)
+		if err != nil {
+			return err
+		}
+	}
+
+	v, err := sqliteVersion(db)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Schema version: %v\n", v)
+	fmt.Printf("Latest version: %v\n", len(sqliteMigrations))
+	return nil
+}
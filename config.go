@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// settings are the options that can be changed while the tracker is
+// running by reloading the file given by the -config flag.
+type settings struct {
+	Short     time.Duration
+	Warmup    time.Duration
+	Uncertain bool
+	NoOutages bool
+}
+
+// currentSettings holds the settings that are in effect. Once coord
+// is running, it's only changed by coord, but it can be read from
+// anywhere with getSettings.
+var currentSettings atomic.Value
+
+// getSettings returns the settings that are in effect.
+func getSettings() settings {
+	return currentSettings.Load().(settings)
+}
+
+// flagSettings returns the settings given on the command line.
+func flagSettings() settings {
+	return settings{
+		Short:     flags.short,
+		Warmup:    flags.warmup,
+		Uncertain: flags.uncertain,
+		NoOutages: flags.nooutages,
+	}
+}
+
+// loadConfig reads settings from the config file at path. The file
+// has one setting per line in the form name=value, using the same
+// names and values as the command line flags, and lines starting with
+// # are ignored. Settings that aren't in the file keep the values that
+// were given on the command line.
+func loadConfig(path string) (settings, error) {
+	s := flagSettings()
+
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.Var((*durationFlag)(&s.Short), "short", "")
+	fs.Var((*durationFlag)(&s.Warmup), "warmup", "")
+	fs.BoolVar(&s.Uncertain, "uncertain", s.Uncertain, "")
+	fs.BoolVar(&s.NoOutages, "nooutages", s.NoOutages, "")
+
+	file, err := os.Open(path)
+	if err != nil {
+		return s, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if (line == "") || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return s, fmt.Errorf("Line %v: expected name=value, got %q", n, line)
+		}
+
+		name := strings.TrimSpace(kv[0])
+		if fs.Lookup(name) == nil {
+			return s, fmt.Errorf("Line %v: %q can't be set in the config file", n, name)
+		}
+
+		err := fs.Set(name, strings.TrimSpace(kv[1]))
+		if err != nil {
+			return s, fmt.Errorf("Line %v: invalid value for %q: %v", n, name, err)
+		}
+	}
+
+	return s, scanner.Err()
+}
+
+// reloadSettings loads the config file given by the -config flag and
+// puts its settings into effect. Nothing is changed if the file can't
+// be loaded.
+func reloadSettings() (settings, error) {
+	if flags.config == "" {
+		return getSettings(), errors.New("No config file was given with -config")
+	}
+
+	s, err := loadConfig(flags.config)
+	if err != nil {
+		return getSettings(), err
+	}
+
+	currentSettings.Store(s)
+	return s, nil
+}
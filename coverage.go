@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// coverageUpdate is how often the end of the current interval is
+// saved while the tracker is connected. If the tracker stops
+// unexpectedly, up to this much coverage may be lost.
+const coverageUpdate = time.Minute
+
+// An Interval is a period of time during which the tracker was
+// connected and subscribed to events.
+type Interval struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// Duration returns the length of the interval.
+func (i Interval) Duration() time.Duration {
+	return i.End.Sub(i.Start)
+}
+
+// coverage keeps track of the intervals during which the tracker was
+// connected. It is only safe to use from a single goroutine.
+type coverage struct {
+	db DB
+
+	// first is the start of the earliest interval ever recorded.
+	first time.Time
+
+	// covered is the total length of all of the intervals, not
+	// including the current one.
+	covered time.Duration
+
+	// cur is the current interval. It's nil while disconnected.
+	cur *Interval
+
+	// lastSave is the last time that cur was saved.
+	lastSave time.Time
+}
+
+// loadCoverage loads the previously recorded intervals from db.
+func loadCoverage(db DB) (*coverage, error) {
+	c := &coverage{db: db}
+
+	intervals, err := db.Intervals()
+	if err != nil {
+		return c, err
+	}
+
+	for _, i := range intervals {
+		if c.first.IsZero() || i.Start.Before(c.first) {
+			c.first = i.Start
+		}
+		c.covered += i.Duration()
+	}
+
+	return c, nil
+}
+
+// Connect starts a new interval at t if one isn't already in
+// progress.
+func (c *coverage) Connect(t time.Time) {
+	if c.cur != nil {
+		return
+	}
+
+	c.cur = &Interval{Start: t, End: t}
+	if c.first.IsZero() {
+		c.first = t
+	}
+	c.save(t)
+}
+
+// Disconnect ends the current interval at t, if there is one.
+func (c *coverage) Disconnect(t time.Time) {
+	if c.cur == nil {
+		return
+	}
+
+	c.cur.End = t
+	c.save(t)
+
+	c.covered += c.cur.Duration()
+	c.cur = nil
+}
+
+// Update extends the current interval to t. To avoid constantly
+// writing to the database, it's only saved every coverageUpdate.
+func (c *coverage) Update(t time.Time) {
+	if c.cur == nil {
+		return
+	}
+
+	c.cur.End = t
+	if t.Sub(c.lastSave) >= coverageUpdate {
+		c.save(t)
+	}
+}
+
+func (c *coverage) save(t time.Time) {
+	c.lastSave = t
+
+	err := c.db.SaveInterval(*c.cur)
+	if err != nil {
+		log.Printf("Failed to save coverage: %v", err)
+	}
+}
+
+// Percent returns the percentage of the time since the tracker was
+// first run that it has been connected for.
+func (c *coverage) Percent(now time.Time) float64 {
+	if c.first.IsZero() {
+		return 0
+	}
+
+	covered := c.covered
+	if c.cur != nil {
+		covered += now.Sub(c.cur.Start)
+	}
+
+	total := now.Sub(c.first)
+	if total <= 0 {
+		return 100
+	}
+
+	return 100 * float64(covered) / float64(total)
+}
+
+// OverlapsGap returns true if a session that started at login may
+// have overlapped a period during which the tracker was disconnected.
+// Only the current run of the tracker is considered, as sessions that
+// started before it aren't tracked. Login times from events only have
+// a resolution of a second, so the start of the interval is truncated
+// to match.
+func (c *coverage) OverlapsGap(login time.Time) bool {
+	return (c.cur == nil) || login.Before(c.cur.Start.Truncate(time.Second))
+}
+
+// serveCoverage returns a handler that serves the recorded intervals,
+// the gaps between them, and the total coverage as JSON.
+func serveCoverage(db DB) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		intervals, err := db.Intervals()
+		if err != nil {
+			log.Printf("Failed to get coverage: %v", err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		gaps := make([]Interval, 0, len(intervals))
+		for i := 1; i < len(intervals); i++ {
+			gaps = append(gaps, Interval{
+				Start: intervals[i-1].End,
+				End:   intervals[i].Start,
+			})
+		}
+
+		e := json.NewEncoder(rw)
+		err = e.Encode(map[string]interface{}{
+			"coverage":  (<-session).Coverage,
+			"intervals": intervals,
+			"gaps":      gaps,
+		})
+		if err != nil {
+			log.Printf("Failed to write coverage: %v", err)
+		}
+	})
+}
@@ -3,28 +3,123 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
+	"io/ioutil"
 	"log"
 	"os"
 	"reflect"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 )
 
+// DB is a database that stores the currently tracked characters and
+// the session. Implementations must be safe for concurrent use.
 type DB interface {
 	SetChar(int64, time.Time) error
 	GetChar(int64) (time.Time, bool, error)
 	OldestChar() (int64, time.Time, error)
 	RemoveChar(int64) error
 	NumChar() int
+	EachChar(func(id int64, login time.Time) error) error
+
+	// EachCharByLogin is like EachChar, but goes through the
+	// characters in order of login time, oldest first, or newest first
+	// if newest is true.
+	EachCharByLogin(newest bool, f func(id int64, login time.Time) error) error
+
+	// ClearChars removes every character. Characters that were online
+	// when the tracker stopped may have logged out since then, so the
+	// tracker clears them when it starts. Nothing else should, as the
+	// database may belong to a running tracker.
+	ClearChars() error
+
+	AddRecord(Record) error
+	EachRecord(func(Record) error) error
+
+	// RecordsAfter returns up to n records in order of logout time and
+	// then character ID, starting after the record of character id
+	// that ended at logout. The first page is read with the zero
+	// values. Unlike EachRecord, nothing is held open in the database
+	// between pages.
+	RecordsAfter(logout time.Time, id int64, n int) ([]Record, error)
+
+	PruneRecords(before time.Time) (int, error)
+	EachRollup(func(Rollup) error) error
+
+	// RollupsAfter is like RecordsAfter, but for rollups, which are in
+	// order of day and then world.
+	RollupsAfter(day string, world int64, n int) ([]Rollup, error)
+
+	MergeRollup(Rollup) error
 
 	LoadSession() (Session, error)
 	SaveSession(s Session) error
 
+	SaveEpoch(Epoch) error
+	Epochs() ([]Epoch, error)
+
+	SaveInterval(Interval) error
+	Intervals() ([]Interval, error)
+
+	AddOutage(Outage) error
+	Outages(n int) ([]Outage, error)
+	PruneOutages(before time.Time) (int, error)
+
+	GetProfile(int64) (Profile, bool, error)
+	SaveProfile(Profile) error
+	EachProfile(func(Profile) error) error
+
 	Close() error
 }
 
+// errNoSession is returned by LoadSession when there is no saved
+// session to load.
+var errNoSession = errors.New("No saved session")
+
+// createDB opens the DB configured by the -db flag for the tracker
+// itself. sqlite DBs are wrapped in a writeBehindDB, unless the flush
+// option turns that off.
 func createDB() (DB, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+
+	sdb, ok := db.(*sqliteDB)
+	if !ok {
+		return db, nil
+	}
+
+	interval, max := time.Second, 1000
+	if f := flags.db["flush"]; f != "" {
+		interval, err = time.ParseDuration(f)
+		if err != nil {
+			sdb.Close()
+			return nil, fmt.Errorf("Bad flush option: %v", err)
+		}
+	}
+	if b := flags.db["batch"]; b != "" {
+		max, err = strconv.Atoi(b)
+		if err != nil {
+			sdb.Close()
+			return nil, fmt.Errorf("Bad batch option: %v", err)
+		}
+	}
+	if interval <= 0 {
+		return sdb, nil
+	}
+
+	return newwriteBehindDB(sdb, interval, max), nil
+}
+
+// openDB opens the DB configured by the -db flag without changing
+// anything in it, so that commands can use it while the tracker is
+// running.
+func openDB() (DB, error) {
 	switch t := flags.db["type"]; t {
 	case "map":
 		log.Printf("Using %q for DB.", t)
@@ -32,8 +127,20 @@ func createDB() (DB, error) {
 		if flags.db["s"] == "" {
 			flags.db["s"] = "session.json"
 		}
+		if flags.db["e"] == "" {
+			flags.db["e"] = "epochs.json"
+		}
+		if flags.db["c"] == "" {
+			flags.db["c"] = "coverage.json"
+		}
+		if flags.db["o"] == "" {
+			flags.db["o"] = "outages.json"
+		}
+		if flags.db["p"] == "" {
+			flags.db["p"] = "profiles.json"
+		}
 
-		return make(mapDB), nil
+		return newmapDB(), nil
 
 	case "sqlite", "sqlite3":
 		log.Printf("Using %q for DB.", t)
@@ -42,232 +149,1374 @@ func createDB() (DB, error) {
 			flags.db["db"] = "session.db"
 		}
 
-		return newsqliteDB(flags.db["db"])
+		db, err := newsqliteDB(flags.db["db"])
+		if err != nil {
+			return nil, err
+		}
+
+		return db, nil
+
+	case "bolt", "bbolt":
+		log.Printf("Using %q for DB.", t)
+
+		if flags.db["db"] == "" {
+			flags.db["db"] = "session.bolt"
+		}
+
+		return newboltDB(flags.db["db"])
+
+	case "postgres", "postgresql":
+		log.Printf("Using %q for DB.", t)
+
+		if flags.db["dsn"] == "" {
+			return nil, fmt.Errorf("The %q DB requires a dsn option", t)
+		}
+
+		return newpostgresDB(flags.db["dsn"])
 	}
 
 	return nil, fmt.Errorf("Bad db flag value: %v", flags.db)
 }
 
-type mapDB map[int64]time.Time
+// A Record is a completed session of a single character.
+type Record struct {
+	CharID int64     `json:"id"`
+	World  int64     `json:"world"`
+	Login  time.Time `json:"login"`
+	Logout time.Time `json:"logout"`
+
+	// Flags describes how trustworthy the record is.
+	Flags recordFlag `json:"flags"`
+}
+
+// recordFlag is a set of flags that mark a record as being less
+// trustworthy than it otherwise would be.
+type recordFlag int
+
+const (
+	// recordUncertain marks a session that started during the warm-up
+	// period after the tracker started or reconnected, or while the
+	// tracker was disconnected.
+	recordUncertain recordFlag = 1 << iota
+
+	// recordGap marks a session that overlapped a period during which
+	// the tracker was disconnected. Events may have been missed during
+	// that period, so its length may be wrong.
+	recordGap
+
+	// recordOutage marks a session that was ended by an outage.
+	recordOutage
+)
+
+// Duration returns the length of the recorded session.
+func (r Record) Duration() time.Duration {
+	return r.Logout.Sub(r.Login)
+}
+
+// after returns true if r comes after the record of character id that
+// ended at logout in the order used by RecordsAfter.
+func (r Record) after(logout time.Time, id int64) bool {
+	if !r.Logout.Equal(logout) {
+		return r.Logout.After(logout)
+	}
+
+	return r.CharID > id
+}
+
+// mapDB is a DB that keeps characters and records in memory. Only the
+// session, epochs, coverage, outages, and profiles are saved to disk.
+type mapDB struct {
+	m       sync.RWMutex
+	chars   map[int64]time.Time
+	records []Record
+	rollups rollups
+
+	// profiles holds the profiles from the profiles file, which is
+	// loaded the first time that it's needed. Changes are written back
+	// along with the session, and when the DB is closed, if dirty is
+	// set.
+	profilesOnce sync.Once
+	profilesErr  error
+	profiles     map[int64]Profile
+	dirty        bool
+}
+
+func newmapDB() *mapDB {
+	return &mapDB{
+		chars:   make(map[int64]time.Time),
+		rollups: make(rollups),
+	}
+}
+
+func (db *mapDB) SetChar(id int64, login time.Time) error {
+	db.m.Lock()
+	defer db.m.Unlock()
 
-func (db mapDB) SetChar(id int64, login time.Time) error {
-	db[id] = login
+	db.chars[id] = login
 	return nil
 }
 
-func (db mapDB) GetChar(id int64) (time.Time, bool, error) {
-	login, ok := db[id]
+func (db *mapDB) GetChar(id int64) (time.Time, bool, error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
+
+	login, ok := db.chars[id]
 	return login, ok, nil
 }
 
-func (db mapDB) OldestChar() (int64, time.Time, error) {
-	// TODO: Implement.
-	panic("Not implemented.")
+func (db *mapDB) OldestChar() (oldest int64, t time.Time, err error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
+
+	for id, login := range db.chars {
+		if (oldest == 0) || login.Before(t) {
+			oldest, t = id, login
+		}
+	}
+
+	return oldest, t, nil
 }
 
-func (db mapDB) RemoveChar(id int64) error {
-	delete(db, id)
+func (db *mapDB) RemoveChar(id int64) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+
+	delete(db.chars, id)
 	return nil
 }
 
-func (db mapDB) NumChar() int {
-	return len(db)
+func (db *mapDB) ClearChars() error {
+	db.m.Lock()
+	defer db.m.Unlock()
+
+	db.chars = make(map[int64]time.Time)
+	return nil
 }
 
-func (db mapDB) LoadSession() (s Session, err error) {
-	defer func() {
-		s.db = db
-	}()
+func (db *mapDB) NumChar() int {
+	db.m.RLock()
+	defer db.m.RUnlock()
 
-	file, err := os.Open(flags.db["s"])
-	if err != nil {
-		return s, err
+	return len(db.chars)
+}
+
+func (db *mapDB) EachChar(f func(int64, time.Time) error) error {
+	db.m.RLock()
+	defer db.m.RUnlock()
+
+	for id, login := range db.chars {
+		err := f(id, login)
+		if err != nil {
+			return err
+		}
 	}
-	defer file.Close()
 
-	d := json.NewDecoder(file)
-	err = d.Decode(&s)
-	return s, err
+	return nil
 }
 
-func (db mapDB) SaveSession(s Session) error {
-	file, err := os.Create(flags.db["s"])
-	if err != nil {
-		return err
+func (db *mapDB) EachCharByLogin(newest bool, f func(int64, time.Time) error) error {
+	type char struct {
+		id    int64
+		login time.Time
+	}
+
+	// The characters are copied so that the lock isn't held while f
+	// runs.
+	db.m.RLock()
+	chars := make([]char, 0, len(db.chars))
+	for id, login := range db.chars {
+		chars = append(chars, char{id: id, login: login})
+	}
+	db.m.RUnlock()
+
+	sort.Slice(chars, func(i, j int) bool {
+		if !chars[i].login.Equal(chars[j].login) {
+			return chars[i].login.Before(chars[j].login) != newest
+		}
+		return (chars[i].id < chars[j].id) != newest
+	})
+
+	for _, c := range chars {
+		err := f(c.id, c.login)
+		if err != nil {
+			return err
+		}
 	}
-	defer file.Close()
 
-	e := json.NewEncoder(file)
-	return e.Encode(&s)
+	return nil
 }
 
-func (db mapDB) Close() error {
+func (db *mapDB) AddRecord(r Record) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+
+	// Records are kept in the order used by RecordsAfter. They nearly
+	// always arrive in that order, so this is usually an append.
+	i := sort.Search(len(db.records), func(i int) bool {
+		return db.records[i].after(r.Logout, r.CharID)
+	})
+	db.records = append(db.records, Record{})
+	copy(db.records[i+1:], db.records[i:])
+	db.records[i] = r
 	return nil
 }
 
-// TODO: Find a way to do some of this asynchronously.
-type sqliteDB struct {
-	*sql.DB
+func (db *mapDB) EachRecord(f func(Record) error) error {
+	db.m.RLock()
+	defer db.m.RUnlock()
 
-	add    *sql.Stmt
-	get    *sql.Stmt
-	oldest *sql.Stmt
-	rem    *sql.Stmt
-	num    *sql.Stmt
+	for _, r := range db.records {
+		err := f(r)
+		if err != nil {
+			return err
+		}
+	}
 
-	sadd *sql.Stmt
-	sget *sql.Stmt
+	return nil
 }
 
-func newsqliteDB(path string) (DB, error) {
-	db, err := sql.Open("sqlite3", path)
-	if err != nil {
-		return nil, err
+func (db *mapDB) RecordsAfter(logout time.Time, id int64, n int) ([]Record, error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
+
+	i := sort.Search(len(db.records), func(i int) bool {
+		return db.records[i].after(logout, id)
+	})
+	end := i + n
+	if end > len(db.records) {
+		end = len(db.records)
 	}
 
-	_, err = db.Exec(`DROP TABLE IF EXISTS chars`)
-	if err != nil {
-		return nil, err
+	return append([]Record(nil), db.records[i:end]...), nil
+}
+
+func (db *mapDB) PruneRecords(before time.Time) (int, error) {
+	db.m.Lock()
+	defer db.m.Unlock()
+
+	kept := db.records[:0]
+	for _, r := range db.records {
+		if r.Logout.Before(before) {
+			db.rollups.Add(r)
+			continue
+		}
+		kept = append(kept, r)
 	}
 
-	_, err = db.Exec(`CREATE TABLE chars (id INTEGER PRIMARY KEY, login TIMESTAMP)`)
-	if err != nil {
-		return nil, err
+	n := len(db.records) - len(kept)
+	db.records = kept
+	return n, nil
+}
+
+func (db *mapDB) EachRollup(f func(Rollup) error) error {
+	db.m.RLock()
+	defer db.m.RUnlock()
+
+	for _, r := range db.rollups {
+		err := f(*r)
+		if err != nil {
+			return err
+		}
 	}
 
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS session (id TEXT PRIMARY KEY, valstr TEXT, valint INTEGER)`)
-	if err != nil {
-		return nil, err
+	return nil
+}
+
+func (db *mapDB) RollupsAfter(day string, world int64, n int) ([]Rollup, error) {
+	db.m.RLock()
+	var page []Rollup
+	for k, r := range db.rollups {
+		if (k.day > day) || ((k.day == day) && (k.world > world)) {
+			page = append(page, *r)
+		}
 	}
+	db.m.RUnlock()
 
-	add, err := db.Prepare(`INSERT OR REPLACE INTO chars (id, login) VALUES (?, ?)`)
-	if err != nil {
-		return nil, err
+	sort.Slice(page, func(i, j int) bool {
+		if page[i].Day != page[j].Day {
+			return page[i].Day < page[j].Day
+		}
+		return page[i].World < page[j].World
+	})
+	if len(page) > n {
+		page = page[:n]
 	}
 
-	get, err := db.Prepare(`SELECT login FROM chars WHERE id=?`)
-	if err != nil {
-		return nil, err
+	return page, nil
+}
+
+func (db *mapDB) MergeRollup(r Rollup) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+
+	db.rollups.Merge(r)
+	return nil
+}
+
+func (db *mapDB) LoadSession() (s Session, err error) {
+	defer func() {
+		s.db = db
+	}()
+
+	path := flags.db["s"]
+	s, err = loadSessionFile(path)
+	if err == nil {
+		return s, nil
 	}
 
-	oldest, err := db.Prepare(`SELECT id, login, min(login) FROM chars`)
-	if err != nil {
-		return nil, err
+	// The session file is broken or missing, so fall back to the
+	// newest backup that can be loaded.
+	backups, berr := listBackups(path)
+	if berr != nil {
+		log.Printf("Failed to list session backups: %v", berr)
 	}
+	for _, backup := range backups {
+		bs, berr := loadSessionFile(backup)
+		if berr != nil {
+			log.Printf("Failed to load session backup %q: %v", backup, berr)
+			continue
+		}
 
-	rem, err := db.Prepare(`DELETE FROM chars WHERE id=?`)
+		log.Printf("Failed to load session from %q: %v", path, err)
+		log.Printf("Recovered session from backup %q", backup)
+		bs.Recovered = backup
+		return bs, nil
+	}
+
+	return s, err
+}
+
+// loadSessionFile loads a session from the file at path.
+func loadSessionFile(path string) (Session, error) {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		return nil, err
+		return Session{}, err
 	}
 
-	num, err := db.Prepare(`SELECT count(id) FROM chars`)
+	return unmarshalSession(data)
+}
+
+func (db *mapDB) SaveSession(s Session) error {
+	data, err := marshalSession(s)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	db.m.Lock()
+	defer db.m.Unlock()
+
+	keep := 5
+	if b := flags.db["backups"]; b != "" {
+		keep, err = strconv.Atoi(b)
+		if err != nil {
+			return fmt.Errorf("Bad backups option: %v", err)
+		}
 	}
 
-	sadd, err := db.Prepare(`INSERT OR REPLACE INTO session (id, valstr, valint) VALUES (?, ?, ?)`)
+	err = backupFile(flags.db["s"], keep)
 	if err != nil {
-		return nil, err
+		log.Printf("Failed to back up session: %v", err)
 	}
 
-	sget, err := db.Prepare(`SELECT valstr, valint FROM session WHERE id=?`)
+	err = db.saveProfiles()
 	if err != nil {
-		return nil, err
+		log.Printf("Failed to save profiles: %v", err)
 	}
 
-	return &sqliteDB{
-		DB: db,
+	return writeFileAtomic(flags.db["s"], data)
+}
 
-		add:    add,
-		get:    get,
-		oldest: oldest,
-		rem:    rem,
-		num:    num,
+func (db *mapDB) SaveEpoch(epoch Epoch) error {
+	db.m.Lock()
+	defer db.m.Unlock()
 
-		sadd: sadd,
-		sget: sget,
-	}, nil
+	var epochs []Epoch
+	err := loadJSONFile(flags.db["e"], &epochs)
+	if err != nil {
+		return err
+	}
+
+	return saveJSONFile(flags.db["e"], append(epochs, epoch))
 }
 
-func (db *sqliteDB) SetChar(id int64, login time.Time) error {
-	_, err := db.add.Exec(id, login)
-	return err
+func (db *mapDB) Epochs() (epochs []Epoch, err error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
+
+	err = loadJSONFile(flags.db["e"], &epochs)
+	return epochs, err
 }
 
-func (db *sqliteDB) GetChar(id int64) (time.Time, bool, error) {
-	var login time.Time
-	err := db.get.QueryRow(id).Scan(&login)
+func (db *mapDB) SaveInterval(i Interval) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+
+	var intervals []Interval
+	err := loadJSONFile(flags.db["c"], &intervals)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return login, false, nil
-		}
+		return err
+	}
 
-		return login, false, err
+	n := len(intervals)
+	if (n > 0) && intervals[n-1].Start.Equal(i.Start) {
+		intervals[n-1] = i
+	} else {
+		intervals = append(intervals, i)
 	}
 
-	return login, true, nil
+	return saveJSONFile(flags.db["c"], intervals)
 }
 
-func (db *sqliteDB) OldestChar() (id int64, t time.Time, err error) {
-	var min string
-	err = db.oldest.QueryRow().Scan(&id, &t, &min)
-	return
-}
+func (db *mapDB) Intervals() (intervals []Interval, err error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
 
-func (db *sqliteDB) RemoveChar(id int64) error {
-	_, err := db.rem.Exec(id)
-	return err
+	err = loadJSONFile(flags.db["c"], &intervals)
+	return intervals, err
 }
 
-func (db *sqliteDB) NumChar() (n int) {
-	err := db.num.QueryRow().Scan(&n)
+func (db *mapDB) AddOutage(o Outage) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+
+	var outages []Outage
+	err := loadJSONFile(flags.db["o"], &outages)
 	if err != nil {
-		log.Printf("Failed to get number of active characters: %v", err)
+		return err
 	}
 
-	return n
+	return saveJSONFile(flags.db["o"], append(outages, o))
 }
 
-func (db *sqliteDB) LoadSession() (s Session, err error) {
-	err = walkStruct(&s, func(name string, field reflect.Value) error {
-		var valstr string
-		var valint int64
-		err := db.sget.QueryRow(name).Scan(&valstr, &valint)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				// Just ignore fields that aren't in the database.
-				return nil
-			}
-
-			return err
-		}
+func (db *mapDB) Outages(n int) (outages []Outage, err error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
 
-		switch field.Kind() {
-		case reflect.String:
-			field.SetString(valstr)
-		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-			field.SetInt(valint)
-		}
+	err = loadJSONFile(flags.db["o"], &outages)
+	if err != nil {
+		return nil, err
+	}
 
-		return nil
-	})
+	if len(outages) > n {
+		outages = outages[len(outages)-n:]
+	}
+	for i, j := 0, len(outages)-1; i < j; i, j = i+1, j-1 {
+		outages[i], outages[j] = outages[j], outages[i]
+	}
 
-	s.db = db
-	return
+	return outages, nil
 }
 
-func (db *sqliteDB) SaveSession(s Session) error {
-	return walkStruct(&s, func(name string, field reflect.Value) (err error) {
-		switch field.Kind() {
-		case reflect.String:
-			_, err = db.sadd.Exec(name, field.String(), 0)
-		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-			_, err = db.sadd.Exec(name, "", field.Int())
+func (db *mapDB) PruneOutages(before time.Time) (int, error) {
+	db.m.Lock()
+	defer db.m.Unlock()
+
+	var outages []Outage
+	err := loadJSONFile(flags.db["o"], &outages)
+	if err != nil {
+		return 0, err
+	}
+
+	kept := outages[:0]
+	for _, o := range outages {
+		if o.End.Before(before) {
+			continue
+		}
+		kept = append(kept, o)
+	}
+	if len(kept) == len(outages) {
+		return 0, nil
+	}
+
+	return len(outages) - len(kept), saveJSONFile(flags.db["o"], kept)
+}
+
+// loadProfiles loads the profiles file the first time that it's
+// called.
+func (db *mapDB) loadProfiles() error {
+	db.profilesOnce.Do(func() {
+		profiles := make(map[int64]Profile)
+		db.profilesErr = loadJSONFile(flags.db["p"], &profiles)
+		db.profiles = profiles
+	})
+
+	return db.profilesErr
+}
+
+// saveProfiles writes the profiles back to the profiles file if they
+// have changed. It must be called with db.m held.
+func (db *mapDB) saveProfiles() error {
+	if !db.dirty {
+		return nil
+	}
+
+	err := saveJSONFile(flags.db["p"], db.profiles)
+	if err != nil {
+		return err
+	}
+
+	db.dirty = false
+	return nil
+}
+
+func (db *mapDB) GetProfile(id int64) (Profile, bool, error) {
+	err := db.loadProfiles()
+	if err != nil {
+		return Profile{}, false, err
+	}
+
+	db.m.RLock()
+	defer db.m.RUnlock()
+
+	p, ok := db.profiles[id]
+	return p, ok, nil
+}
+
+func (db *mapDB) SaveProfile(p Profile) error {
+	err := db.loadProfiles()
+	if err != nil {
+		return err
+	}
+
+	db.m.Lock()
+	defer db.m.Unlock()
+
+	db.profiles[p.ID] = p
+	db.dirty = true
+	return nil
+}
+
+func (db *mapDB) EachProfile(f func(Profile) error) error {
+	err := db.loadProfiles()
+	if err != nil {
+		return err
+	}
+
+	db.m.RLock()
+	defer db.m.RUnlock()
+
+	for _, p := range db.profiles {
+		err := f(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadJSONFile decodes the JSON in the file at path into v. A missing
+// file is not considered an error, and leaves v untouched.
+func loadJSONFile(path string, v interface{}) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+	defer file.Close()
+
+	d := json.NewDecoder(file)
+	return d.Decode(v)
+}
+
+// saveJSONFile replaces the file at path with the JSON encoding of v.
+func saveJSONFile(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, data)
+}
+
+func (db *mapDB) Close() error {
+	db.m.Lock()
+	defer db.m.Unlock()
+
+	return db.saveProfiles()
+}
+
+// sqliteDB is a DB that stores everything in a SQLite database. Unless
+// disabled, it is wrapped in a writeBehindDB to avoid writing every
+// change to characters separately.
+type sqliteDB struct {
+	*sql.DB
+
+	add    *sql.Stmt
+	get    *sql.Stmt
+	oldest *sql.Stmt
+	rem    *sql.Stmt
+	num    *sql.Stmt
+	each   *sql.Stmt
+	asc    *sql.Stmt
+	desc   *sql.Stmt
+
+	radd  *sql.Stmt
+	reach *sql.Stmt
+	rpage *sql.Stmt
+
+	sadd *sql.Stmt
+	sget *sql.Stmt
+
+	eadd *sql.Stmt
+	eget *sql.Stmt
+
+	cadd *sql.Stmt
+	cget *sql.Stmt
+
+	oadd *sql.Stmt
+	oget *sql.Stmt
+
+	padd *sql.Stmt
+	pget *sql.Stmt
+}
+
+func newsqliteDB(path string) (*sqliteDB, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = migrateSqlite(db, len(sqliteMigrations))
+	if err != nil {
+		return nil, err
+	}
+
+	add, err := db.Prepare(`INSERT OR REPLACE INTO chars (id, login) VALUES (?, ?)`)
+	if err != nil {
+		return nil, err
+	}
+
+	get, err := db.Prepare(`SELECT login FROM chars WHERE id=?`)
+	if err != nil {
+		return nil, err
+	}
+
+	oldest, err := db.Prepare(`SELECT id, login FROM chars ORDER BY login, id LIMIT 1`)
+	if err != nil {
+		return nil, err
+	}
+
+	rem, err := db.Prepare(`DELETE FROM chars WHERE id=?`)
+	if err != nil {
+		return nil, err
+	}
+
+	num, err := db.Prepare(`SELECT count(id) FROM chars`)
+	if err != nil {
+		return nil, err
+	}
+
+	each, err := db.Prepare(`SELECT id, login FROM chars`)
+	if err != nil {
+		return nil, err
+	}
+
+	asc, err := db.Prepare(`SELECT id, login FROM chars ORDER BY login, id`)
+	if err != nil {
+		return nil, err
+	}
+
+	desc, err := db.Prepare(`SELECT id, login FROM chars ORDER BY login DESC, id DESC`)
+	if err != nil {
+		return nil, err
+	}
+
+	radd, err := db.Prepare(`INSERT INTO records (char, world, login, logout, flags) VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		return nil, err
+	}
+
+	reach, err := db.Prepare(`SELECT char, world, login, logout, flags FROM records`)
+	if err != nil {
+		return nil, err
+	}
+
+	rpage, err := db.Prepare(`SELECT char, world, login, logout, flags FROM records WHERE (logout, char) > (?, ?) ORDER BY logout, char LIMIT ?`)
+	if err != nil {
+		return nil, err
+	}
+
+	sadd, err := db.Prepare(`INSERT OR REPLACE INTO session_data (id, data) VALUES (1, ?)`)
+	if err != nil {
+		return nil, err
+	}
+
+	sget, err := db.Prepare(`SELECT data FROM session_data WHERE id=1`)
+	if err != nil {
+		return nil, err
+	}
+
+	eadd, err := db.Prepare(`INSERT INTO epochs (label, start, end, session) VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		return nil, err
+	}
+
+	eget, err := db.Prepare(`SELECT label, start, end, session FROM epochs ORDER BY end`)
+	if err != nil {
+		return nil, err
+	}
+
+	cadd, err := db.Prepare(`INSERT OR REPLACE INTO coverage (start, end) VALUES (?, ?)`)
+	if err != nil {
+		return nil, err
+	}
+
+	cget, err := db.Prepare(`SELECT start, end FROM coverage ORDER BY start`)
+	if err != nil {
+		return nil, err
+	}
+
+	oadd, err := db.Prepare(`INSERT INTO outages (world, start, end, logouts) VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		return nil, err
+	}
+
+	oget, err := db.Prepare(`SELECT world, start, end, logouts FROM outages ORDER BY end DESC LIMIT ?`)
+	if err != nil {
+		return nil, err
+	}
+
+	padd, err := db.Prepare(`INSERT OR REPLACE INTO profiles (id, name, outfit_id, outfit_alias, faction, world, battle_rank, refreshed, missing) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return nil, err
+	}
+
+	pget, err := db.Prepare(`SELECT name, outfit_id, outfit_alias, faction, world, battle_rank, refreshed, missing FROM profiles WHERE id=?`)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqliteDB{
+		DB: db,
+
+		add:    add,
+		get:    get,
+		oldest: oldest,
+		rem:    rem,
+		num:    num,
+		each:   each,
+		asc:    asc,
+		desc:   desc,
+
+		radd:  radd,
+		reach: reach,
+		rpage: rpage,
+
+		sadd: sadd,
+		sget: sget,
+
+		eadd: eadd,
+		eget: eget,
+
+		cadd: cadd,
+		cget: cget,
+
+		oadd: oadd,
+		oget: oget,
+
+		padd: padd,
+		pget: pget,
+	}, nil
+}
+
+func (db *sqliteDB) SetChar(id int64, login time.Time) error {
+	_, err := db.add.Exec(id, login)
+	return err
+}
+
+func (db *sqliteDB) GetChar(id int64) (time.Time, bool, error) {
+	var login time.Time
+	err := db.get.QueryRow(id).Scan(&login)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return login, false, nil
+		}
+
+		return login, false, err
+	}
+
+	return login, true, nil
+}
+
+func (db *sqliteDB) OldestChar() (id int64, t time.Time, err error) {
+	err = db.oldest.QueryRow().Scan(&id, &t)
+	if err == sql.ErrNoRows {
+		return 0, time.Time{}, nil
+	}
+	return
+}
+
+func (db *sqliteDB) RemoveChar(id int64) error {
+	_, err := db.rem.Exec(id)
+	return err
+}
+
+func (db *sqliteDB) ClearChars() error {
+	_, err := db.Exec(`DELETE FROM chars`)
+	return err
+}
+
+func (db *sqliteDB) NumChar() (n int) {
+	err := db.num.QueryRow().Scan(&n)
+	if err != nil {
+		log.Printf("Failed to get number of active characters: %v", err)
+	}
+
+	return n
+}
+
+func (db *sqliteDB) EachChar(f func(int64, time.Time) error) error {
+	return eachCharRow(db.each, f)
+}
+
+func (db *sqliteDB) EachCharByLogin(newest bool, f func(int64, time.Time) error) error {
+	if newest {
+		return eachCharRow(db.desc, f)
+	}
+
+	return eachCharRow(db.asc, f)
+}
+
+// eachCharRow calls f with the ID and login time in each row returned
+// by stmt.
+func eachCharRow(stmt *sql.Stmt, f func(int64, time.Time) error) error {
+	rows, err := stmt.Query()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var login time.Time
+		err = rows.Scan(&id, &login)
+		if err != nil {
+			return err
+		}
+
+		err = f(id, login)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (db *sqliteDB) AddRecord(r Record) error {
+	_, err := db.radd.Exec(r.CharID, r.World, r.Login, r.Logout, r.Flags)
+	return err
+}
+
+func (db *sqliteDB) EachRecord(f func(Record) error) error {
+	rows, err := db.reach.Query()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Record
+		err = rows.Scan(&r.CharID, &r.World, &r.Login, &r.Logout, &r.Flags)
+		if err != nil {
+			return err
+		}
+
+		err = f(r)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (db *sqliteDB) RecordsAfter(logout time.Time, id int64, n int) ([]Record, error) {
+	rows, err := db.rpage.Query(logout, id, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := make([]Record, 0, n)
+	for rows.Next() {
+		var r Record
+		err = rows.Scan(&r.CharID, &r.World, &r.Login, &r.Logout, &r.Flags)
+		if err != nil {
+			return nil, err
+		}
+
+		page = append(page, r)
+	}
+
+	return page, rows.Err()
+}
+
+func (db *sqliteDB) PruneRecords(before time.Time) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT char, world, login, logout, flags FROM records WHERE logout < ?`, before)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	rs := make(rollups)
+	for rows.Next() {
+		var r Record
+		err = rows.Scan(&r.CharID, &r.World, &r.Login, &r.Logout, &r.Flags)
+		if err != nil {
+			return 0, err
+		}
+
+		rs.Add(r)
+	}
+	err = rows.Err()
+	if err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	for _, ru := range rs {
+		err = sqliteMergeRollup(tx, *ru)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	res, err := tx.Exec(`DELETE FROM records WHERE logout < ?`, before)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), tx.Commit()
+}
+
+// sqliteMergeRollup merges r into the matching rollup in the
+// database as part of tx.
+func sqliteMergeRollup(tx *sql.Tx, r Rollup) error {
+	var old Rollup
+	err := tx.QueryRow(`SELECT sessions, total, longest FROM rollups WHERE day=? AND world=?`, r.Day, r.World).Scan(&old.Sessions, &old.Total, &old.Longest)
+	if (err != nil) && (err != sql.ErrNoRows) {
+		return err
+	}
+	r.Merge(old)
+
+	_, err = tx.Exec(`INSERT OR REPLACE INTO rollups (day, world, sessions, total, longest) VALUES (?, ?, ?, ?, ?)`, r.Day, r.World, r.Sessions, r.Total, r.Longest)
+	return err
+}
+
+func (db *sqliteDB) MergeRollup(r Rollup) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = sqliteMergeRollup(tx, r)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *sqliteDB) EachRollup(f func(Rollup) error) error {
+	rows, err := db.Query(`SELECT day, world, sessions, total, longest FROM rollups ORDER BY day, world`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Rollup
+		err = rows.Scan(&r.Day, &r.World, &r.Sessions, &r.Total, &r.Longest)
+		if err != nil {
+			return err
+		}
+
+		err = f(r)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (db *sqliteDB) RollupsAfter(day string, world int64, n int) ([]Rollup, error) {
+	rows, err := db.Query(`SELECT day, world, sessions, total, longest FROM rollups WHERE (day, world) > (?, ?) ORDER BY day, world LIMIT ?`, day, world, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := make([]Rollup, 0, n)
+	for rows.Next() {
+		var r Rollup
+		err = rows.Scan(&r.Day, &r.World, &r.Sessions, &r.Total, &r.Longest)
+		if err != nil {
+			return nil, err
+		}
+
+		page = append(page, r)
+	}
+
+	return page, rows.Err()
+}
+
+func (db *sqliteDB) LoadSession() (s Session, err error) {
+	defer func() {
+		s.db = db
+	}()
+
+	var data string
+	err = db.sget.QueryRow().Scan(&data)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return db.loadLegacySession()
 		}
+
+		return s, err
+	}
+
+	return unmarshalSession([]byte(data))
+}
+
+// loadLegacySession loads a session that was stored field by field
+// in the session table before sessions were stored as a whole. If one
+// is found, it's converted to the new format and the old rows are
+// removed.
+func (db *sqliteDB) loadLegacySession() (s Session, err error) {
+	var found bool
+	err = walkStruct(&s, func(name string, field reflect.Value) error {
+		var valstr string
+		var valint int64
+		err := db.QueryRow(`SELECT valstr, valint FROM session WHERE id=?`, name).Scan(&valstr, &valint)
 		if err != nil {
-			log.Fatalf("Failed to save %q (%v): %v", name, field.Interface(), err)
+			if err == sql.ErrNoRows {
+				// Just ignore fields that aren't in the database.
+				return nil
+			}
+
+			return err
+		}
+		found = true
+
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(valstr)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			field.SetInt(valint)
 		}
 
-		return
+		return nil
 	})
+	if err != nil {
+		return s, err
+	}
+	if !found {
+		return s, errNoSession
+	}
+
+	log.Println("Converting session from legacy format...")
+
+	data, err := marshalSession(s)
+	if err != nil {
+		return s, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return s, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Stmt(db.sadd).Exec(string(data))
+	if err != nil {
+		return s, err
+	}
+
+	_, err = tx.Exec(`DELETE FROM session`)
+	if err != nil {
+		return s, err
+	}
+
+	return s, tx.Commit()
+}
+
+func (db *sqliteDB) SaveSession(s Session) error {
+	data, err := marshalSession(s)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.sadd.Exec(string(data))
+	return err
+}
+
+func (db *sqliteDB) SaveEpoch(epoch Epoch) error {
+	data, err := json.Marshal(epoch.Session)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.eadd.Exec(epoch.Label, epoch.Start, epoch.End, string(data))
+	return err
+}
+
+func (db *sqliteDB) Epochs() (epochs []Epoch, err error) {
+	rows, err := db.eget.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var epoch Epoch
+		var data string
+		err = rows.Scan(&epoch.Label, &epoch.Start, &epoch.End, &data)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal([]byte(data), &epoch.Session)
+		if err != nil {
+			return nil, err
+		}
+
+		epochs = append(epochs, epoch)
+	}
+
+	return epochs, rows.Err()
+}
+
+func (db *sqliteDB) SaveInterval(i Interval) error {
+	_, err := db.cadd.Exec(i.Start, i.End)
+	return err
+}
+
+func (db *sqliteDB) Intervals() (intervals []Interval, err error) {
+	rows, err := db.cget.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i Interval
+		err = rows.Scan(&i.Start, &i.End)
+		if err != nil {
+			return nil, err
+		}
+
+		intervals = append(intervals, i)
+	}
+
+	return intervals, rows.Err()
+}
+
+func (db *sqliteDB) AddOutage(o Outage) error {
+	_, err := db.oadd.Exec(o.World, o.Start, o.End, o.Logouts)
+	return err
+}
+
+func (db *sqliteDB) Outages(n int) (outages []Outage, err error) {
+	rows, err := db.oget.Query(n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var o Outage
+		err = rows.Scan(&o.World, &o.Start, &o.End, &o.Logouts)
+		if err != nil {
+			return nil, err
+		}
+
+		outages = append(outages, o)
+	}
+
+	return outages, rows.Err()
+}
+
+func (db *sqliteDB) PruneOutages(before time.Time) (int, error) {
+	res, err := db.Exec(`DELETE FROM outages WHERE end < ?`, before)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (db *sqliteDB) GetProfile(id int64) (Profile, bool, error) {
+	p := Profile{ID: id}
+	err := db.pget.QueryRow(id).Scan(&p.Name, &p.OutfitID, &p.OutfitAlias, &p.Faction, &p.World, &p.BattleRank, &p.Refreshed, &p.Missing)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return p, false, nil
+		}
+
+		return p, false, err
+	}
+
+	return p, true, nil
+}
+
+func (db *sqliteDB) SaveProfile(p Profile) error {
+	_, err := db.padd.Exec(p.ID, p.Name, p.OutfitID, p.OutfitAlias, p.Faction, p.World, p.BattleRank, p.Refreshed, p.Missing)
+	return err
+}
+
+func (db *sqliteDB) EachProfile(f func(Profile) error) error {
+	return eachProfileRow(db.DB, `SELECT id, name, outfit_id, outfit_alias, faction, world, battle_rank, refreshed, missing FROM profiles`, f)
+}
+
+// eachProfileRow calls f with the profile in each row returned by q.
+func eachProfileRow(db *sql.DB, q string, f func(Profile) error) error {
+	rows, err := db.Query(q)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p Profile
+		err = rows.Scan(&p.ID, &p.Name, &p.OutfitID, &p.OutfitAlias, &p.Faction, &p.World, &p.BattleRank, &p.Refreshed, &p.Missing)
+		if err != nil {
+			return err
+		}
+
+		err = f(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// Import imports an archive in a single transaction.
+func (db *sqliteDB) Import(a *archive, s *Session) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if s != nil {
+		data, err := marshalSession(*s)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Stmt(db.sadd).Exec(string(data))
+		if err != nil {
+			return fmt.Errorf("Failed to save session: %v", err)
+		}
+	}
+
+	add := tx.Stmt(db.add)
+	for _, c := range a.Chars {
+		_, err = add.Exec(c.ID, c.Login)
+		if err != nil {
+			return fmt.Errorf("Failed to add character %v: %v", c.ID, err)
+		}
+	}
+
+	radd := tx.Stmt(db.radd)
+	for _, r := range a.Records {
+		_, err = radd.Exec(r.CharID, r.World, r.Login, r.Logout, r.Flags)
+		if err != nil {
+			return fmt.Errorf("Failed to add record: %v", err)
+		}
+	}
+
+	for _, r := range a.Rollups {
+		err = sqliteMergeRollup(tx, r)
+		if err != nil {
+			return fmt.Errorf("Failed to add rollup: %v", err)
+		}
+	}
+
+	eadd := tx.Stmt(db.eadd)
+	for _, epoch := range a.Epochs {
+		data, err := json.Marshal(epoch.Session)
+		if err != nil {
+			return err
+		}
+
+		_, err = eadd.Exec(epoch.Label, epoch.Start, epoch.End, string(data))
+		if err != nil {
+			return fmt.Errorf("Failed to add epoch %q: %v", epoch.Label, err)
+		}
+	}
+
+	cadd := tx.Stmt(db.cadd)
+	for _, i := range a.Intervals {
+		_, err = cadd.Exec(i.Start, i.End)
+		if err != nil {
+			return fmt.Errorf("Failed to add coverage: %v", err)
+		}
+	}
+
+	oadd := tx.Stmt(db.oadd)
+	for _, o := range a.Outages {
+		_, err = oadd.Exec(o.World, o.Start, o.End, o.Logouts)
+		if err != nil {
+			return fmt.Errorf("Failed to add outage: %v", err)
+		}
+	}
+
+	padd := tx.Stmt(db.padd)
+	for _, p := range a.Profiles {
+		_, err = padd.Exec(p.ID, p.Name, p.OutfitID, p.OutfitAlias, p.Faction, p.World, p.BattleRank, p.Refreshed, p.Missing)
+		if err != nil {
+			return fmt.Errorf("Failed to add profile of %v: %v", p.ID, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Compact vacuums the database, returning the number of bytes that
+// were reclaimed.
+func (db *sqliteDB) Compact() (int64, error) {
+	size := func() (int64, error) {
+		var pages, pageSize int64
+		err := db.QueryRow(`PRAGMA page_count`).Scan(&pages)
+		if err != nil {
+			return 0, err
+		}
+
+		err = db.QueryRow(`PRAGMA page_size`).Scan(&pageSize)
+		return pages * pageSize, err
+	}
+
+	before, err := size()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = db.Exec(`VACUUM`)
+	if err != nil {
+		return 0, err
+	}
+
+	after, err := size()
+	return before - after, err
 }
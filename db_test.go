@@ -0,0 +1,348 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The flags are parsed by an init function, which runs before the
+// test binary would normally register its own flags, so they're
+// registered here instead. Package variables are initialized before
+// any init function runs.
+var _ = func() bool {
+	testing.Init()
+	return true
+}()
+
+// testDB runs the conformance suite that every DB backend has to pass
+// against db, which must be empty.
+func testDB(t *testing.T, db DB) {
+	t.Helper()
+
+	t.Run("Chars", func(t *testing.T) {
+		id, login, err := db.OldestChar()
+		if err != nil {
+			t.Fatalf("OldestChar on empty DB: %v", err)
+		}
+		if id != 0 {
+			t.Errorf("OldestChar on empty DB returned %v, %v", id, login)
+		}
+		if n := db.NumChar(); n != 0 {
+			t.Errorf("NumChar on empty DB returned %v", n)
+		}
+
+		base := time.Unix(1500000000, 0)
+		chars := map[int64]time.Time{
+			1: base.Add(2 * time.Hour),
+			2: base,
+			3: base.Add(time.Hour),
+		}
+		for id, login := range chars {
+			err := db.SetChar(id, login)
+			if err != nil {
+				t.Fatalf("SetChar(%v): %v", id, err)
+			}
+		}
+
+		for id, want := range chars {
+			login, ok, err := db.GetChar(id)
+			if err != nil {
+				t.Fatalf("GetChar(%v): %v", id, err)
+			}
+			if !ok || !login.Equal(want) {
+				t.Errorf("GetChar(%v) returned %v, %v, expected %v, true", id, login, ok, want)
+			}
+		}
+
+		_, ok, err := db.GetChar(4)
+		if err != nil {
+			t.Fatalf("GetChar of missing char: %v", err)
+		}
+		if ok {
+			t.Errorf("GetChar found a char that was never set")
+		}
+
+		if n := db.NumChar(); n != len(chars) {
+			t.Errorf("NumChar returned %v, expected %v", n, len(chars))
+		}
+
+		id, login, err = db.OldestChar()
+		if err != nil {
+			t.Fatalf("OldestChar: %v", err)
+		}
+		if (id != 2) || !login.Equal(base) {
+			t.Errorf("OldestChar returned %v, %v, expected 2, %v", id, login, base)
+		}
+
+		// Setting a char again replaces its login time rather than
+		// adding it twice.
+		err = db.SetChar(2, base.Add(3*time.Hour))
+		if err != nil {
+			t.Fatalf("SetChar(2) again: %v", err)
+		}
+		if n := db.NumChar(); n != len(chars) {
+			t.Errorf("NumChar after replacing a char returned %v, expected %v", n, len(chars))
+		}
+		id, _, err = db.OldestChar()
+		if err != nil {
+			t.Fatalf("OldestChar: %v", err)
+		}
+		if id != 3 {
+			t.Errorf("OldestChar after replacing the oldest char returned %v, expected 3", id)
+		}
+
+		for id := range chars {
+			err := db.RemoveChar(id)
+			if err != nil {
+				t.Fatalf("RemoveChar(%v): %v", id, err)
+			}
+		}
+		_, ok, err = db.GetChar(1)
+		if err != nil {
+			t.Fatalf("GetChar of removed char: %v", err)
+		}
+		if ok {
+			t.Errorf("GetChar found a removed char")
+		}
+		if n := db.NumChar(); n != 0 {
+			t.Errorf("NumChar after removing every char returned %v", n)
+		}
+		id, _, err = db.OldestChar()
+		if err != nil {
+			t.Fatalf("OldestChar after removing every char: %v", err)
+		}
+		if id != 0 {
+			t.Errorf("OldestChar after removing every char returned %v", id)
+		}
+
+		for id, login := range chars {
+			err := db.SetChar(id, login)
+			if err != nil {
+				t.Fatalf("SetChar(%v): %v", id, err)
+			}
+		}
+		err = db.ClearChars()
+		if err != nil {
+			t.Fatalf("ClearChars: %v", err)
+		}
+		if n := db.NumChar(); n != 0 {
+			t.Errorf("NumChar after ClearChars returned %v", n)
+		}
+		_, ok, err = db.GetChar(1)
+		if err != nil {
+			t.Fatalf("GetChar of cleared char: %v", err)
+		}
+		if ok {
+			t.Errorf("GetChar found a cleared char")
+		}
+	})
+
+	t.Run("Records", func(t *testing.T) {
+		day := time.Date(2017, 7, 14, 0, 0, 0, 0, time.UTC)
+		records := []Record{
+			{CharID: 3, World: 1, Login: day.Add(time.Hour), Logout: day.Add(3 * time.Hour)},
+			{CharID: 1, World: 1, Login: day, Logout: day.Add(2 * time.Hour)},
+			{CharID: 2, World: 13, Login: day.Add(time.Hour), Logout: day.Add(2 * time.Hour)},
+			{CharID: 1, World: 1, Login: day.Add(24 * time.Hour), Logout: day.Add(25 * time.Hour)},
+		}
+		for _, r := range records {
+			err := db.AddRecord(r)
+			if err != nil {
+				t.Fatalf("AddRecord: %v", err)
+			}
+		}
+
+		// Reading a page at a time with pages smaller than the number of
+		// records has to return each of them once, in order.
+		var got []Record
+		var logout time.Time
+		var id int64
+		for {
+			page, err := db.RecordsAfter(logout, id, 3)
+			if err != nil {
+				t.Fatalf("RecordsAfter: %v", err)
+			}
+			got = append(got, page...)
+			if len(page) < 3 {
+				break
+			}
+			logout, id = page[len(page)-1].Logout, page[len(page)-1].CharID
+		}
+
+		order := []int{1, 2, 0, 3}
+		if len(got) != len(order) {
+			t.Fatalf("RecordsAfter returned %v records, expected %v", len(got), len(order))
+		}
+		for i, j := range order {
+			if (got[i].CharID != records[j].CharID) || !got[i].Logout.Equal(records[j].Logout) {
+				t.Errorf("Record %v is %v at %v, expected %v at %v", i, got[i].CharID, got[i].Logout, records[j].CharID, records[j].Logout)
+			}
+		}
+
+		n, err := db.PruneRecords(day.Add(24 * time.Hour))
+		if err != nil {
+			t.Fatalf("PruneRecords: %v", err)
+		}
+		if n != 3 {
+			t.Errorf("PruneRecords pruned %v records, expected 3", n)
+		}
+
+		rollups, err := db.RollupsAfter("", 0, 1)
+		if err != nil {
+			t.Fatalf("RollupsAfter: %v", err)
+		}
+		if (len(rollups) != 1) || (rollups[0].World != 1) || (rollups[0].Sessions != 2) || (rollups[0].Longest != jsonDuration(2*time.Hour)) {
+			t.Fatalf("First rollup is %+v, expected 2 sessions on world 1 with the longest being 2h", rollups)
+		}
+		rollups, err = db.RollupsAfter(rollups[0].Day, rollups[0].World, 10)
+		if err != nil {
+			t.Fatalf("RollupsAfter: %v", err)
+		}
+		if (len(rollups) != 1) || (rollups[0].World != 13) || (rollups[0].Sessions != 1) {
+			t.Errorf("Remaining rollups are %+v, expected 1 session on world 13", rollups)
+		}
+	})
+
+	t.Run("Session", func(t *testing.T) {
+		_, err := db.LoadSession()
+		if err != errNoSession {
+			t.Errorf("LoadSession on empty DB returned %v, expected %v", err, errNoSession)
+		}
+
+		logout := time.Unix(1500003600, 0).UTC()
+		want := Session{
+			Total:        RollingAverage{Cur: jsonDuration(90 * time.Minute), Num: 10},
+			NoShort:      RollingAverage{Cur: jsonDuration(2 * time.Hour), Num: 6},
+			Uncertain:    RollingAverage{Cur: jsonDuration(time.Hour), Num: 2},
+			Longest:      jsonDuration(5 * time.Hour),
+			LongestName:  "[TAG] Name",
+			ShortestLong: jsonDuration(61 * time.Minute),
+			Shortest:     jsonDuration(time.Minute),
+			Leaderboard: []LeaderboardEntry{
+				{CharID: 1, Name: "First", World: 17, Duration: jsonDuration(5 * time.Hour), Logout: logout},
+				{CharID: 2, Name: "Second", World: 13, Duration: jsonDuration(4 * time.Hour), Logout: logout},
+			},
+			Worlds: map[int64]*WorldStats{
+				13: {Total: RollingAverage{Cur: jsonDuration(time.Hour), Num: 4}, Sessions: 5, Longest: jsonDuration(4 * time.Hour)},
+				17: {Total: RollingAverage{Cur: jsonDuration(2 * time.Hour), Num: 6}, Sessions: 6, Longest: jsonDuration(5 * time.Hour)},
+			},
+			EpochStart:     unixTime(1500000000),
+			GapSessions:    3,
+			Outages:        1,
+			OutageSessions: 200,
+		}
+
+		err = db.SaveSession(want)
+		if err != nil {
+			t.Fatalf("SaveSession: %v", err)
+		}
+
+		got, err := db.LoadSession()
+		if err != nil {
+			t.Fatalf("LoadSession: %v", err)
+		}
+		for i := range got.Leaderboard {
+			got.Leaderboard[i].Logout = got.Leaderboard[i].Logout.UTC()
+		}
+
+		for _, f := range []struct {
+			name      string
+			got, want interface{}
+		}{
+			{"Total", got.Total, want.Total},
+			{"NoShort", got.NoShort, want.NoShort},
+			{"Uncertain", got.Uncertain, want.Uncertain},
+			{"Longest", got.Longest, want.Longest},
+			{"LongestName", got.LongestName, want.LongestName},
+			{"ShortestLong", got.ShortestLong, want.ShortestLong},
+			{"Shortest", got.Shortest, want.Shortest},
+			{"Leaderboard", got.Leaderboard, want.Leaderboard},
+			{"Worlds", got.Worlds, want.Worlds},
+			{"EpochStart", got.EpochStart, want.EpochStart},
+			{"GapSessions", got.GapSessions, want.GapSessions},
+			{"Outages", got.Outages, want.Outages},
+			{"OutageSessions", got.OutageSessions, want.OutageSessions},
+		} {
+			if !reflect.DeepEqual(f.got, f.want) {
+				t.Errorf("Loaded %v is %+v, expected %+v", f.name, f.got, f.want)
+			}
+		}
+
+		// Saving again replaces the session instead of adding to it.
+		want.Leaderboard = want.Leaderboard[:1]
+		delete(want.Worlds, 13)
+		err = db.SaveSession(want)
+		if err != nil {
+			t.Fatalf("SaveSession again: %v", err)
+		}
+		got, err = db.LoadSession()
+		if err != nil {
+			t.Fatalf("LoadSession again: %v", err)
+		}
+		if (len(got.Leaderboard) != 1) || (len(got.Worlds) != 1) {
+			t.Errorf("Saving again left %v leaderboard entries and %v worlds, expected 1 of each", len(got.Leaderboard), len(got.Worlds))
+		}
+	})
+}
+
+func TestSqliteDB(t *testing.T) {
+	db, err := newsqliteDB(filepath.Join(t.TempDir(), "session.db"))
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+	defer db.Close()
+
+	testDB(t, db)
+}
+
+func TestWriteBehindDB(t *testing.T) {
+	db, err := newsqliteDB(filepath.Join(t.TempDir(), "session.db"))
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+	wb := newwriteBehindDB(db, time.Hour, 1000)
+	defer wb.Close()
+
+	testDB(t, wb)
+}
+
+func TestBoltDB(t *testing.T) {
+	db, err := newboltDB(filepath.Join(t.TempDir(), "session.bolt"))
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+	defer db.Close()
+
+	testDB(t, db)
+}
+
+// TestPostgresDB runs the suite against the PostgreSQL database given
+// by the PS2_TEST_PG_DSN environment variable. The database should be
+// a throwaway one, as the tracker's tables in it are dropped first.
+func TestPostgresDB(t *testing.T) {
+	dsn := os.Getenv("PS2_TEST_PG_DSN")
+	if dsn == "" {
+		t.Skip("PS2_TEST_PG_DSN is not set")
+	}
+
+	db, err := newpostgresDB(dsn)
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+	_, err = db.(*postgresDB).Exec(`DROP TABLE chars, records, session_stats, session_leaderboard, session_worlds, epochs, coverage, outages, rollups, profiles`)
+	if err != nil {
+		t.Fatalf("Failed to drop tables: %v", err)
+	}
+	db.Close()
+
+	db, err = newpostgresDB(dsn)
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+	defer db.Close()
+
+	testDB(t, db)
+}
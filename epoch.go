@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// An Epoch is a session that has been archived so that a new one
+// could be started in its place.
+type Epoch struct {
+	// Label is the name that the epoch was archived under.
+	Label string `json:"label"`
+
+	// Start and End are the times that the epoch was started and
+	// archived, respectively.
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	// Session is the session as it was when it was archived.
+	Session Session `json:"session"`
+}
+
+// epochRequest is a request for coord to archive the current session
+// and start a new one. The result of the archival is sent to err.
+type epochRequest struct {
+	label string
+	err   chan<- error
+}
+
+// newEpoch asks coord to archive the current session under label.
+func newEpoch(label string) error {
+	err := make(chan error)
+	epochs <- epochRequest{label: label, err: err}
+	return <-err
+}
+
+// archiveSession archives s in db under label and returns a new
+// session to replace it with. The new session is not saved.
+func archiveSession(db DB, s Session, label string) (Session, error) {
+	if label == "" {
+		return s, errors.New("Epoch label must not be empty")
+	}
+
+	now := time.Now()
+
+	archived := s
+	archived.Err = nil
+	archived.db = nil
+
+	err := db.SaveEpoch(Epoch{
+		Label:   label,
+		Start:   time.Unix(int64(s.EpochStart), 0),
+		End:     now,
+		Session: archived,
+	})
+	if err != nil {
+		return s, err
+	}
+
+	return freshSession(s, now), nil
+}
+
+// freshSession returns a session with no statistics to replace s with,
+// starting at now. Only the state of the tracker itself, such as its
+// runtime and the oldest active session, is carried over.
+func freshSession(s Session, now time.Time) Session {
+	fresh := Session{
+		Runtime:    s.Runtime,
+		Oldest:     s.Oldest,
+		OldestName: s.OldestName,
+		EpochStart: unixTime(now.Unix()),
+		db:         s.db,
+	}
+	initSession(&fresh)
+
+	return fresh
+}
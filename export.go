@@ -0,0 +1,529 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportFlushEvery is the number of rows written between flushes of
+// an export, so that clients start receiving data right away.
+const exportFlushEvery = 100
+
+// exportPage is the number of rows that exports read from the database
+// at a time. Nothing is held open in the database while a page is
+// written to the client, so a slow client can't hold up the tracker.
+const exportPage = 500
+
+// exportFilter is the filter given by the query parameters of an
+// export request.
+type exportFilter struct {
+	// from and to are the bounds of the time range, inclusive and
+	// exclusive respectively. Either can be zero for no bound.
+	from, to time.Time
+
+	// world is the world to include, or 0 for every world.
+	world int64
+}
+
+// parseExportTime parses a time given as either an RFC 3339 timestamp
+// or a UTC date.
+func parseExportTime(v string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, v)
+	if err == nil {
+		return t, nil
+	}
+
+	return time.Parse(rollupDayFormat, v)
+}
+
+// parseExportFilter parses the from, to, and world parameters of req.
+// world can be either an ID or a name.
+func parseExportFilter(req *http.Request) (f exportFilter, err error) {
+	if v := req.FormValue("from"); v != "" {
+		f.from, err = parseExportTime(v)
+		if err != nil {
+			return f, fmt.Errorf("Invalid from: %q", v)
+		}
+	}
+
+	if v := req.FormValue("to"); v != "" {
+		f.to, err = parseExportTime(v)
+		if err != nil {
+			return f, fmt.Errorf("Invalid to: %q", v)
+		}
+	}
+
+	if v := req.FormValue("world"); v != "" {
+		f.world, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			for id, name := range worlds {
+				if strings.EqualFold(name, v) {
+					f.world, err = id, nil
+					break
+				}
+			}
+		}
+		if err != nil {
+			return f, fmt.Errorf("Unknown world: %q", v)
+		}
+	}
+
+	return f, nil
+}
+
+// includes returns true if something that happened at t on world
+// passes the filter.
+func (f exportFilter) includes(t time.Time, world int64) bool {
+	if !f.from.IsZero() && t.Before(f.from) {
+		return false
+	}
+	if !f.to.IsZero() && !t.Before(f.to) {
+		return false
+	}
+
+	return (f.world == 0) || (world == f.world)
+}
+
+// exportWriter writes rows of an export as either CSV or NDJSON.
+type exportWriter struct {
+	rw http.ResponseWriter
+
+	csv  *csv.Writer
+	json *json.Encoder
+
+	n int
+}
+
+// newExportWriter returns an exportWriter for the format requested by
+// req, either with the format parameter or the Accept header. CSV is
+// the default. The CSV header row is written immediately.
+func newExportWriter(rw http.ResponseWriter, req *http.Request, name string, header []string) (*exportWriter, error) {
+	format := req.FormValue("format")
+	if format == "" {
+		format = "csv"
+
+	accept:
+		for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+			t, _, _ := mime.ParseMediaType(strings.TrimSpace(accept))
+			switch t {
+			case "application/x-ndjson", "application/jsonl", "application/json":
+				format = "ndjson"
+				break accept
+			case "text/csv":
+				break accept
+			}
+		}
+	}
+
+	w := &exportWriter{rw: rw}
+	switch format {
+	case "csv":
+		rw.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.csv = csv.NewWriter(rw)
+	case "ndjson":
+		rw.Header().Set("Content-Type", "application/x-ndjson")
+		w.json = json.NewEncoder(rw)
+	default:
+		return nil, fmt.Errorf("Unknown format: %q", format)
+	}
+
+	rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+format))
+	rw.Header().Set("Cache-Control", "no-store")
+
+	if w.csv != nil {
+		err := w.csv.Write(header)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return w, nil
+}
+
+// Write writes a single row. v is written for NDJSON and row is
+// written for CSV.
+func (w *exportWriter) Write(v interface{}, row []string) error {
+	var err error
+	if w.csv != nil {
+		err = w.csv.Write(row)
+	} else {
+		err = w.json.Encode(v)
+	}
+	if err != nil {
+		return err
+	}
+
+	w.n++
+	if w.n%exportFlushEvery == 0 {
+		w.Flush()
+	}
+
+	return nil
+}
+
+// Flush sends everything that's been written so far to the client.
+func (w *exportWriter) Flush() {
+	if w.csv != nil {
+		w.csv.Flush()
+	}
+	if f, ok := w.rw.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// recordPager reads records from a DB a page at a time with
+// RecordsAfter.
+type recordPager struct {
+	db   DB
+	page []Record
+	done bool
+
+	// logout and id identify the last record that was read.
+	logout time.Time
+	id     int64
+}
+
+// Peek returns the next record without moving past it. ok is false if
+// there are no records left.
+func (p *recordPager) Peek() (r Record, ok bool, err error) {
+	if (len(p.page) == 0) && !p.done {
+		p.page, err = p.db.RecordsAfter(p.logout, p.id, exportPage)
+		if err != nil {
+			return r, false, err
+		}
+		if len(p.page) < exportPage {
+			p.done = true
+		}
+		if len(p.page) > 0 {
+			last := p.page[len(p.page)-1]
+			p.logout, p.id = last.Logout, last.CharID
+		}
+	}
+
+	if len(p.page) == 0 {
+		return r, false, nil
+	}
+	return p.page[0], true, nil
+}
+
+// Next moves past the record returned by Peek.
+func (p *recordPager) Next() {
+	p.page = p.page[1:]
+}
+
+// rollupPager reads rollups from a DB a page at a time with
+// RollupsAfter.
+type rollupPager struct {
+	db   DB
+	page []Rollup
+	done bool
+
+	// day and world identify the last rollup that was read.
+	day   string
+	world int64
+}
+
+// Peek returns the next rollup without moving past it. ok is false if
+// there are no rollups left.
+func (p *rollupPager) Peek() (r Rollup, ok bool, err error) {
+	if (len(p.page) == 0) && !p.done {
+		p.page, err = p.db.RollupsAfter(p.day, p.world, exportPage)
+		if err != nil {
+			return r, false, err
+		}
+		if len(p.page) < exportPage {
+			p.done = true
+		}
+		if len(p.page) > 0 {
+			last := p.page[len(p.page)-1]
+			p.day, p.world = last.Day, last.World
+		}
+	}
+
+	if len(p.page) == 0 {
+		return r, false, nil
+	}
+	return p.page[0], true, nil
+}
+
+// Next moves past the rollup returned by Peek.
+func (p *rollupPager) Next() {
+	p.page = p.page[1:]
+}
+
+// formatSeconds formats a duration as a number of seconds for CSV.
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
+
+type exportSession struct {
+	ID        int64     `json:"id"`
+	World     int64     `json:"world"`
+	WorldName string    `json:"world_name"`
+	Login     time.Time `json:"login"`
+	Logout    time.Time `json:"logout"`
+	Duration  float64   `json:"duration_seconds"`
+	Uncertain bool      `json:"uncertain"`
+	Gap       bool      `json:"gap"`
+	Outage    bool      `json:"outage"`
+}
+
+type exportRollup struct {
+	Day       string  `json:"day"`
+	World     int64   `json:"world"`
+	WorldName string  `json:"world_name"`
+	Sessions  int64   `json:"sessions"`
+	Total     float64 `json:"total_seconds"`
+	Average   float64 `json:"average_seconds"`
+	Longest   float64 `json:"longest_seconds"`
+}
+
+type exportOnline struct {
+	ID      int64     `json:"id"`
+	Login   time.Time `json:"login"`
+	Elapsed float64   `json:"elapsed_seconds"`
+}
+
+// serveExport returns a handler that serves an export. run writes the
+// rows of the export to w.
+func serveExport(name string, header []string, run func(w *exportWriter, f exportFilter) error) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		f, err := parseExportFilter(req)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w, err := newExportWriter(rw, req, name, header)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = run(w, f)
+		w.Flush()
+		if err != nil {
+			// The status has already been sent, so all that can be done
+			// is to cut the export short.
+			log.Printf("Failed to export %v: %v", name, err)
+		}
+	})
+}
+
+// serveExportSessions returns a handler that exports the completed
+// sessions in db that ended within the requested time range. Rows are
+// read from the database a page at a time as they're written.
+func serveExportSessions(db DB) http.Handler {
+	header := []string{"id", "world", "world_name", "login", "logout", "duration_seconds", "uncertain", "gap", "outage"}
+
+	return serveExport("sessions", header, func(w *exportWriter, f exportFilter) error {
+		p := &recordPager{db: db}
+		for {
+			r, ok, err := p.Peek()
+			if (err != nil) || !ok {
+				return err
+			}
+			p.Next()
+
+			if !f.includes(r.Logout, r.World) {
+				continue
+			}
+
+			s := exportSession{
+				ID:        r.CharID,
+				World:     r.World,
+				WorldName: worldName(r.World),
+				Login:     r.Login,
+				Logout:    r.Logout,
+				Duration:  r.Duration().Seconds(),
+				Uncertain: r.Flags&recordUncertain != 0,
+				Gap:       r.Flags&recordGap != 0,
+				Outage:    r.Flags&recordOutage != 0,
+			}
+
+			err = w.Write(s, []string{
+				strconv.FormatInt(s.ID, 10),
+				strconv.FormatInt(s.World, 10),
+				s.WorldName,
+				s.Login.Format(time.RFC3339),
+				s.Logout.Format(time.RFC3339),
+				formatSeconds(r.Duration()),
+				strconv.FormatBool(s.Uncertain),
+				strconv.FormatBool(s.Gap),
+				strconv.FormatBool(s.Outage),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// serveExportRollups returns a handler that exports daily rollups
+// within the requested time range. The stored rollups of pruned
+// records are combined with rollups of the records that haven't been
+// pruned yet, so every day is covered. Both are read in order of day,
+// so only a single day is held in memory at a time.
+func serveExportRollups(db DB) http.Handler {
+	header := []string{"day", "world", "world_name", "sessions", "total_seconds", "average_seconds", "longest_seconds"}
+
+	return serveExport("rollups", header, func(w *exportWriter, f exportFilter) error {
+		stored := &rollupPager{db: db}
+		records := &recordPager{db: db}
+		for {
+			ru, haveRollup, err := stored.Peek()
+			if err != nil {
+				return err
+			}
+			r, haveRecord, err := records.Peek()
+			if err != nil {
+				return err
+			}
+			if !haveRollup && !haveRecord {
+				return nil
+			}
+
+			// A day can have both a stored rollup and records, as records
+			// aren't pruned at day boundaries.
+			day := ru.Day
+			if !haveRollup || (haveRecord && (rollupDay(r.Logout) < day)) {
+				day = rollupDay(r.Logout)
+			}
+
+			rs := make(rollups)
+			for ; haveRollup && (ru.Day == day); ru, haveRollup, err = stored.Peek() {
+				rs.Merge(ru)
+				stored.Next()
+			}
+			if err != nil {
+				return err
+			}
+			for ; haveRecord && (rollupDay(r.Logout) == day); r, haveRecord, err = records.Peek() {
+				rs.Add(r)
+				records.Next()
+			}
+			if err != nil {
+				return err
+			}
+
+			err = writeRollups(w, f, day, rs)
+			if err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// writeRollups writes the rollups for a single day that pass f, in
+// order of world.
+func writeRollups(w *exportWriter, f exportFilter, day string, rs rollups) error {
+	start, err := time.Parse(rollupDayFormat, day)
+	if err != nil {
+		return err
+	}
+
+	list := make([]*Rollup, 0, len(rs))
+	for _, r := range rs {
+		// A day is included if any of it is in the range.
+		if !f.includes(start, r.World) && !f.includes(start.Add(24*time.Hour-1), r.World) {
+			continue
+		}
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].World < list[j].World
+	})
+
+	for _, r := range list {
+		e := exportRollup{
+			Day:       r.Day,
+			World:     r.World,
+			WorldName: worldName(r.World),
+			Sessions:  r.Sessions,
+			Total:     time.Duration(r.Total).Seconds(),
+			Average:   r.Average().Seconds(),
+			Longest:   time.Duration(r.Longest).Seconds(),
+		}
+
+		err := w.Write(e, []string{
+			e.Day,
+			strconv.FormatInt(e.World, 10),
+			e.WorldName,
+			strconv.FormatInt(e.Sessions, 10),
+			formatSeconds(time.Duration(r.Total)),
+			formatSeconds(r.Average()),
+			formatSeconds(time.Duration(r.Longest)),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// serveExportOnline returns a handler that exports the characters in
+// db that are currently online and logged in within the requested
+// time range. The world of online characters isn't known, so the
+// world filter isn't supported.
+func serveExportOnline(db DB) http.Handler {
+	header := []string{"id", "login", "elapsed_seconds"}
+
+	type char struct {
+		id    int64
+		login time.Time
+	}
+
+	h := serveExport("online", header, func(w *exportWriter, f exportFilter) error {
+		// The characters are copied out first so that nothing is held
+		// open in the database while they're written. There are only as
+		// many as are online.
+		var chars []char
+		err := db.EachCharByLogin(false, func(id int64, login time.Time) error {
+			if f.includes(login, 0) {
+				chars = append(chars, char{id: id, login: login})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		for _, c := range chars {
+			e := exportOnline{
+				ID:      c.id,
+				Login:   c.login,
+				Elapsed: now.Sub(c.login).Seconds(),
+			}
+
+			err := w.Write(e, []string{
+				strconv.FormatInt(c.id, 10),
+				c.login.Format(time.RFC3339),
+				formatSeconds(now.Sub(c.login)),
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.FormValue("world") != "" {
+			http.Error(rw, "The online export can't be filtered by world", http.StatusBadRequest)
+			return
+		}
+
+		h.ServeHTTP(rw, req)
+	})
+}
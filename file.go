@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backupTimeFormat is the format of the timestamps in the names of
+// backup files. It sorts lexically in chronological order.
+const backupTimeFormat = "20060102-150405.000000000"
+
+// writeFileAtomic replaces the file at path with data. The data is
+// written to a temporary file which is synced to disk and then
+// renamed over path, so the file at path is never left partially
+// written, even if the process crashes.
+func writeFileAtomic(path string, data []byte) (err error) {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+
+	tmp, err := ioutil.TempFile(dir, base+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+
+	// Sync the directory so that the rename itself is durable. Not
+	// every system supports this, so errors are ignored.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
+
+// backupFile preserves the current contents of the file at path as a
+// timestamped backup next to it, and then removes all but the newest
+// keep backups. It does nothing if the file doesn't exist.
+func backupFile(path string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+
+	name := path + "." + time.Now().UTC().Format(backupTimeFormat) + ".bak"
+	err := os.Link(path, name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		// Hard links aren't supported everywhere, so fall back to
+		// copying.
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		err = writeFileAtomic(name, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	backups, err := listBackups(path)
+	if err != nil {
+		return err
+	}
+	for len(backups) > keep {
+		err = os.Remove(backups[len(backups)-1])
+		if err != nil {
+			return err
+		}
+		backups = backups[:len(backups)-1]
+	}
+
+	return nil
+}
+
+// listBackups returns the backups of the file at path that were made
+// by backupFile, newest first.
+func listBackups(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".*.bak")
+	if err != nil {
+		return nil, err
+	}
+
+	backups := matches[:0]
+	for _, m := range matches {
+		ts := strings.TrimSuffix(strings.TrimPrefix(m, path+"."), ".bak")
+		if _, err := time.Parse(backupTimeFormat, ts); err == nil {
+			backups = append(backups, m)
+		}
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	return backups, nil
+}
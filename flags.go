@@ -10,23 +10,54 @@ import (
 
 // flags stores the command line flags and arguments.
 var flags struct {
-	addr     string
-	short    time.Duration
-	db       mapFlag
-	autosave time.Duration
+	addr      string
+	short     time.Duration
+	db        mapFlag
+	autosave  time.Duration
+	admin     string
+	warmup    time.Duration
+	uncertain bool
+	outage    rateFlag
+	nooutages bool
+	retain    mapFlag
+	profiles  mapFlag
+	backup    mapFlag
+	assets    string
+	ready     time.Duration
+	config    string
+	adminuser string
 }
 
 func init() {
 	flags.short = time.Hour
 	flags.db = mapFlag{"type": "map"}
 	flags.autosave = 5 * time.Minute
+	flags.warmup = time.Hour
+	flags.ready = time.Minute
+	flags.retain = mapFlag{"every": "24h"}
+	flags.profiles = mapFlag{"ttl": "24h", "missing": "1h"}
+	flags.backup = mapFlag{"dir": "backups", "keep": "7"}
 
 	flag.StringVar(&flags.addr, "addr", ":8080", "The address to run the web interface at.")
 	flag.Var((*durationFlag)(&flags.short), "short", "The maximum length of a session to consider short.")
 	flag.Var(&flags.db, "db", "Options for the database.")
 	flag.Var((*durationFlag)(&flags.autosave), "autosave", "Autosave the session every `n`. 0 disables autosaving.")
+	flag.Var((*durationFlag)(&flags.warmup), "warmup", "Sessions starting within `n` of the tracker starting or reconnecting are uncertain.")
+	flag.BoolVar(&flags.uncertain, "uncertain", false, "Include uncertain sessions in the averages.")
+	flag.Var((*durationFlag)(&flags.ready), "ready", "Report the tracker as not ready if no events have been received in `n`.")
+	flag.Var(&flags.outage, "outage", "Consider `n/d` logouts on a single world, such as 200/1m, an outage. Completed sessions are held for d before they're saved, so that they can be flagged. Disabled by default.")
+	flag.BoolVar(&flags.nooutages, "nooutages", false, "Exclude sessions ended by outages from the averages.")
+	flag.Var(&flags.retain, "retain", "Options for pruning old data. records and outages are maximum ages, every is how often to prune, and compact compacts the DB afterwards.")
+	flag.Var(&flags.profiles, "profiles", "Options for the character profile cache. ttl is how long until cached profiles are refreshed, and missing is how long characters that don't exist are remembered for.")
+	flag.Var(&flags.backup, "backup", "Options for backups of the sqlite DB. dir is where backups go, every is how often to make one, keep is how many to keep, and gzip compresses them.")
+	flag.StringVar(&flags.assets, "assets", "", "Serve the web interface's files from `dir`, falling back to the built-in ones for any files that it doesn't have.")
+	flag.StringVar(&flags.config, "config", "", "Load the settings that can be changed at runtime, short, warmup, uncertain, and nooutages, from `file`, which is read again when the admin API asks for a reload.")
+	flag.StringVar(&flags.admin, "admin", "", "The `token` required by admin endpoints. If neither this nor -adminuser is given, admin endpoints are disabled.")
+	flag.StringVar(&flags.adminuser, "adminuser", "", "Also allow admin endpoints with basic auth as `user:password`.")
 
 	flag.Parse()
+
+	currentSettings.Store(flagSettings())
 }
 
 // durationFlag is a wrapper around time.Duration to make it satisfy
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// health keeps track of the state reported by monitor, coord, and
+// autosave for the health and readiness endpoints.
+var health struct {
+	sync.Mutex
+
+	// started is when the process started.
+	started time.Time
+
+	// subscribed is when monitor last subscribed to events, and
+	// lastEvent is when it last received one. eventErr is the last
+	// error that it got, which is cleared by the next event.
+	subscribed time.Time
+	lastEvent  time.Time
+	eventErr   error
+
+	// coordTick is when coord last went around its loop on its own
+	// ticker. If it's old, coord is stuck.
+	coordTick time.Time
+
+	// lastSave is when autosave last tried to save the session, and
+	// saveErr is the error that that returned.
+	lastSave time.Time
+	saveErr  error
+}
+
+func init() {
+	health.started = time.Now()
+}
+
+// reportSubscribed is called by monitor when it subscribes to events.
+func reportSubscribed() {
+	health.Lock()
+	defer health.Unlock()
+
+	health.subscribed = time.Now()
+}
+
+// reportEvent is called by monitor whenever it receives an event or
+// an error while reading one.
+func reportEvent(err error) {
+	health.Lock()
+	defer health.Unlock()
+
+	health.eventErr = err
+	if err == nil {
+		health.lastEvent = time.Now()
+	}
+}
+
+// reportCoord is called by coord every time its ticker fires.
+func reportCoord(now time.Time) {
+	health.Lock()
+	defer health.Unlock()
+
+	health.coordTick = now
+}
+
+// reportSave is called by autosave with the result of every save.
+func reportSave(err error) {
+	health.Lock()
+	defer health.Unlock()
+
+	health.lastSave = time.Now()
+	health.saveErr = err
+}
+
+// A pinger is a DB that can check that it's reachable. DBs backed by
+// database/sql get this from *sql.DB.
+type pinger interface {
+	Ping() error
+}
+
+// pingDB checks that db is reachable. DBs that aren't pingers are
+// checked by looking up a character instead.
+func pingDB(db DB) error {
+	if p, ok := db.(pinger); ok {
+		return p.Ping()
+	}
+
+	_, _, err := db.GetChar(0)
+	return err
+}
+
+// healthCheck is the result of a single readiness check.
+type healthCheck struct {
+	OK    bool                   `json:"ok"`
+	Error string                 `json:"error,omitempty"`
+	Info  map[string]interface{} `json:"info,omitempty"`
+}
+
+// timeOrNil returns t, or nil if it's zero, so that times that never
+// happened show up as null in JSON.
+func timeOrNil(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+
+	return t
+}
+
+// serveHealthz serves a liveness check. It only says that the process
+// is up and able to serve requests.
+func serveHealthz(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+
+	e := json.NewEncoder(rw)
+	err := e.Encode(map[string]interface{}{
+		"status":  "ok",
+		"started": health.started,
+		"uptime":  time.Since(health.started).String(),
+	})
+	if err != nil {
+		log.Printf("Failed to write health: %v", err)
+	}
+}
+
+// serveReadyz returns a handler that serves a readiness check. The
+// tracker is ready if it has subscribed to events and received one
+// within the period given by the -ready flag, coord is running, db is
+// reachable, and the last autosave, if any, succeeded. If it isn't
+// ready, the status code is 503.
+func serveReadyz(db DB) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		now := time.Now()
+		dbErr := pingDB(db)
+
+		health.Lock()
+		events := healthCheck{
+			OK: !health.subscribed.IsZero() && (now.Sub(health.lastEvent) <= flags.ready),
+			Info: map[string]interface{}{
+				"subscribed": timeOrNil(health.subscribed),
+				"last_event": timeOrNil(health.lastEvent),
+			},
+		}
+		switch {
+		case health.eventErr != nil:
+			events.OK = false
+			events.Error = health.eventErr.Error()
+		case health.subscribed.IsZero():
+			events.Error = "Not subscribed to events"
+		case !events.OK:
+			events.Error = "No events received in the last " + flags.ready.String()
+		}
+
+		coord := healthCheck{
+			OK: now.Sub(health.coordTick) <= flags.ready,
+			Info: map[string]interface{}{
+				"last_tick": timeOrNil(health.coordTick),
+			},
+		}
+		if !coord.OK {
+			coord.Error = "Event processing is stalled"
+		}
+
+		autosave := healthCheck{
+			OK: health.saveErr == nil,
+			Info: map[string]interface{}{
+				"last_save": timeOrNil(health.lastSave),
+			},
+		}
+		if health.saveErr != nil {
+			autosave.Error = health.saveErr.Error()
+		}
+		health.Unlock()
+
+		dbCheck := healthCheck{OK: dbErr == nil}
+		if dbErr != nil {
+			dbCheck.Error = dbErr.Error()
+		}
+
+		checks := map[string]healthCheck{
+			"events":   events,
+			"coord":    coord,
+			"db":       dbCheck,
+			"autosave": autosave,
+		}
+
+		ready := true
+		for _, c := range checks {
+			ready = ready && c.OK
+		}
+
+		rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+		rw.Header().Set("Cache-Control", "no-store")
+
+		status := http.StatusOK
+		if !ready {
+			status = http.StatusServiceUnavailable
+		}
+		rw.WriteHeader(status)
+
+		e := json.NewEncoder(rw)
+		err := e.Encode(map[string]interface{}{
+			"ready":  ready,
+			"checks": checks,
+		})
+		if err != nil {
+			log.Printf("Failed to write readiness: %v", err)
+		}
+	})
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// liveBuffer is the number of events that can be waiting to be
+	// sent to a single client. Clients that fall further behind than
+	// that are disconnected, and their browsers reconnect and start
+	// over with a fresh copy of the session.
+	liveBuffer = 64
+
+	// liveInterval is how often coord publishes the session even if
+	// nothing has changed, so that times since things happened stay
+	// up to date.
+	liveInterval = 10 * time.Second
+
+	// liveHeartbeat is how often a comment is sent to idle clients to
+	// keep proxies from closing the connection.
+	liveHeartbeat = 15 * time.Second
+)
+
+// A liveEvent is a single server-sent event.
+type liveEvent struct {
+	name string
+	data []byte
+}
+
+// liveHub fans events out to the clients connected to /live. Publish
+// never blocks, so it's safe to call from coord.
+type liveHub struct {
+	m       sync.Mutex
+	clients map[chan liveEvent]struct{}
+}
+
+// live is the hub that coord publishes to.
+var live = &liveHub{
+	clients: make(map[chan liveEvent]struct{}),
+}
+
+// Subscribe registers a new client and returns the channel that its
+// events are sent on. The channel is closed if the client falls too
+// far behind.
+func (h *liveHub) Subscribe() chan liveEvent {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	c := make(chan liveEvent, liveBuffer)
+	h.clients[c] = struct{}{}
+	return c
+}
+
+// Unsubscribe removes a client that was registered by Subscribe.
+func (h *liveHub) Unsubscribe(c chan liveEvent) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if _, ok := h.clients[c]; ok {
+		delete(h.clients, c)
+		close(c)
+	}
+}
+
+// CloseAll disconnects every client.
+func (h *liveHub) CloseAll() {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	for c := range h.clients {
+		delete(h.clients, c)
+		close(c)
+	}
+}
+
+// Active returns true if any clients are connected.
+func (h *liveHub) Active() bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	return len(h.clients) > 0
+}
+
+// Backlog returns the number of connected clients and the number of
+// events waiting to be sent to the client that's furthest behind.
+func (h *liveHub) Backlog() (clients, max int) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	for c := range h.clients {
+		if len(c) > max {
+			max = len(c)
+		}
+	}
+
+	return len(h.clients), max
+}
+
+// Publish sends an event with the JSON encoding of v as its data to
+// every client. If nobody is connected, v isn't even encoded.
+func (h *liveHub) Publish(name string, v interface{}) {
+	if !h.Active() {
+		return
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Failed to encode %q event: %v", name, err)
+		return
+	}
+	ev := liveEvent{name: name, data: data}
+
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	for c := range h.clients {
+		select {
+		case c <- ev:
+		default:
+			log.Println("Disconnecting slow live client.")
+			delete(h.clients, c)
+			close(c)
+		}
+	}
+}
+
+// liveRecord is the data of a record event.
+type liveRecord struct {
+	Record
+	WorldName string       `json:"worldname"`
+	Duration  jsonDuration `json:"duration"`
+}
+
+// liveOldest is the data of an oldest event.
+type liveOldest struct {
+	Name  string    `json:"name"`
+	Since time.Time `json:"since"`
+}
+
+// serveLive streams updates to the session as server-sent events. A
+// session event with the whole session is sent right away and then
+// whenever it changes, a record event is sent for every completed
+// session, and an oldest event is sent when the longest active
+// session changes.
+func serveLive(rw http.ResponseWriter, req *http.Request) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	c := live.Subscribe()
+	defer live.Unsubscribe(c)
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("X-Accel-Buffering", "no")
+
+	write := func(ev liveEvent) error {
+		_, err := fmt.Fprintf(rw, "event: %s\ndata: %s\n\n", ev.name, ev.data)
+		flusher.Flush()
+		return err
+	}
+
+	data, err := json.Marshal(<-session)
+	if err != nil {
+		log.Printf("Failed to encode session: %v", err)
+		return
+	}
+	err = write(liveEvent{name: "session", data: data})
+	if err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(liveHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case ev, ok := <-c:
+			if !ok {
+				return
+			}
+
+			err := write(ev)
+			if err != nil {
+				return
+			}
+
+		case <-heartbeat.C:
+			_, err := fmt.Fprint(rw, ": ping\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Metrics exported at /metrics. Updating them never blocks, so they
+// can be updated from anywhere, including coord.
+var (
+	metricOnline = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ps2avglogin_online_characters",
+		Help: "Number of online characters being tracked. The faction is unknown until the character's profile has been looked up.",
+	}, []string{"world", "faction"})
+
+	metricEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ps2avglogin_events_total",
+		Help: "Number of events received from Census, by type.",
+	}, []string{"type"})
+
+	metricEventErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ps2avglogin_event_errors_total",
+		Help: "Number of errors received while reading events from Census.",
+	})
+
+	metricReconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ps2avglogin_reconnects_total",
+		Help: "Number of times that the event stream recovered from an error.",
+	})
+
+	metricSessionLength = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "ps2avglogin_session_length_seconds",
+		Help: "Length of completed sessions.",
+
+		// One minute to about 68 hours.
+		Buckets: prometheus.ExponentialBuckets(60, 2, 13),
+	})
+
+	metricAverage = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ps2avglogin_average_session_seconds",
+		Help: "Current average session length, by average.",
+	}, []string{"average"})
+
+	metricProfileLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ps2avglogin_profile_lookups_total",
+		Help: "Number of character profile lookups, by result. hit, stale, and missing are answered from the cache.",
+	}, []string{"result"})
+
+	metricCensusLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ps2avglogin_census_lookup_seconds",
+		Help:    "Latency of character lookups in Census.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	})
+
+	metricDBLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ps2avglogin_db_operation_seconds",
+		Help:    "Latency of database operations, by operation.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"op"})
+
+	metricAutosaves = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ps2avglogin_autosaves_total",
+		Help: "Number of autosaves, by result.",
+	}, []string{"result"})
+
+	metricLastSave = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ps2avglogin_last_save_timestamp_seconds",
+		Help: "Time of the last successful save of the session.",
+	})
+
+	metricDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ps2avglogin_metrics_dropped_total",
+		Help: "Number of online character logins dropped because the metrics queue was full.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricOnline,
+		metricEvents,
+		metricEventErrors,
+		metricReconnects,
+		metricSessionLength,
+		metricAverage,
+		metricProfileLookups,
+		metricCensusLatency,
+		metricDBLatency,
+		metricAutosaves,
+		metricLastSave,
+		metricDropped,
+	)
+}
+
+// observeDB returns a function that records the time since it was
+// called as the latency of the database operation op.
+func observeDB(op string) func() {
+	start := time.Now()
+	return func() {
+		metricDBLatency.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	}
+}
+
+// observeAverages updates the average session length metrics from s.
+func observeAverages(s *Session) {
+	metricAverage.WithLabelValues("total").Set(time.Duration(s.Total.Cur).Seconds())
+	metricAverage.WithLabelValues("noshort").Set(time.Duration(s.NoShort.Cur).Seconds())
+	metricAverage.WithLabelValues("uncertain").Set(time.Duration(s.Uncertain.Cur).Seconds())
+}
+
+// factions maps faction IDs to their abbreviations.
+var factions = map[int64]string{
+	1: "VS",
+	2: "NC",
+	3: "TR",
+	4: "NSO",
+}
+
+// onlineUpdate is a login or logout of a character for onlineMetrics.
+type onlineUpdate struct {
+	id     int64
+	world  int64
+	logout bool
+}
+
+// onlineQueue is the number of updates that can be waiting for
+// onlineMetrics before logins are dropped.
+const onlineQueue = 4096
+
+var onlineUpdates = make(chan onlineUpdate, onlineQueue)
+
+// observeOnline queues an update to the online characters metric. If
+// the queue is full, logins are dropped, which just leaves the
+// character uncounted, but logouts wait for room, as dropping one would
+// leave the character counted forever.
+func observeOnline(id, world int64, logout bool) {
+	u := onlineUpdate{id: id, world: world, logout: logout}
+	if logout {
+		onlineUpdates <- u
+		return
+	}
+
+	select {
+	case onlineUpdates <- u:
+	default:
+		metricDropped.Inc()
+	}
+}
+
+// onlineLookupInterval is how often onlineMetrics looks up the
+// profiles of online characters whose factions aren't known yet.
+const onlineLookupInterval = 10 * time.Second
+
+// onlineLookupBatch is the maximum number of profiles that
+// onlineMetrics looks up at a time.
+const onlineLookupBatch = 10 * profileBatch
+
+// factionLabel returns the faction label of a character.
+func factionLabel(p Profile) string {
+	if f, ok := factions[p.Faction]; ok {
+		return f
+	}
+
+	return strconv.FormatInt(p.Faction, 10)
+}
+
+// onlineMetrics keeps the online characters metric up to date until
+// onlineUpdates is closed. A character's faction is taken from the
+// profiles that pc holds in memory if it can be. Otherwise, it's
+// counted as unknown until its profile is looked up in the background
+// in batches, and then moved to its faction, so that updates are never
+// held up by the database or Census.
+func onlineMetrics(pc *profileCache) {
+	type labels struct {
+		world   string
+		faction string
+	}
+	online := make(map[int64]labels)
+
+	set := func(id int64, l labels) {
+		if old, ok := online[id]; ok {
+			metricOnline.WithLabelValues(old.world, old.faction).Dec()
+		}
+		metricOnline.WithLabelValues(l.world, l.faction).Inc()
+		online[id] = l
+	}
+
+	// unresolved holds the online characters whose profiles haven't
+	// been looked up yet.
+	unresolved := make(map[int64]bool)
+
+	type lookup struct {
+		ids []int64
+		ps  map[int64]Profile
+		err error
+	}
+
+	// results is only non-nil while a lookup is running.
+	var results chan lookup
+
+	tick := time.NewTicker(onlineLookupInterval)
+	defer tick.Stop()
+
+	updates := onlineUpdates
+	for (updates != nil) || (results != nil) {
+		select {
+		case u, ok := <-updates:
+			if !ok {
+				// Wait for the running lookup, if any, so that nothing
+				// uses pc after this returns.
+				updates = nil
+				continue
+			}
+
+			if u.logout {
+				l, ok := online[u.id]
+				if !ok {
+					continue
+				}
+
+				metricOnline.WithLabelValues(l.world, l.faction).Dec()
+				delete(online, u.id)
+				delete(unresolved, u.id)
+				continue
+			}
+
+			if _, ok := online[u.id]; ok {
+				continue
+			}
+
+			l := labels{world: worldName(u.world), faction: "unknown"}
+			if p, ok := pc.Peek(u.id); ok {
+				l.faction = factionLabel(p)
+			} else {
+				unresolved[u.id] = true
+			}
+			set(u.id, l)
+
+		case <-tick.C:
+			if (updates == nil) || (results != nil) || (len(unresolved) == 0) {
+				continue
+			}
+
+			ids := make([]int64, 0, onlineLookupBatch)
+			for id := range unresolved {
+				ids = append(ids, id)
+				delete(unresolved, id)
+				if len(ids) == onlineLookupBatch {
+					break
+				}
+			}
+
+			results = make(chan lookup, 1)
+			go func(ids []int64, results chan<- lookup) {
+				ps, err := pc.GetMany(ids)
+				results <- lookup{ids: ids, ps: ps, err: err}
+			}(ids, results)
+
+		case r := <-results:
+			results = nil
+			if r.err != nil {
+				log.Printf("Failed to look up factions of online characters: %v", r.err)
+			}
+
+			for _, id := range r.ids {
+				l, ok := online[id]
+				if !ok {
+					continue
+				}
+
+				p, ok := r.ps[id]
+				if !ok {
+					// If the lookup failed, the profile may not have been
+					// looked up at all, so it's tried again later.
+					// Otherwise, the character doesn't exist, and stays
+					// unknown.
+					if r.err != nil {
+						unresolved[id] = true
+					}
+					continue
+				}
+
+				set(id, labels{world: l.world, faction: factionLabel(p)})
+			}
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// sqliteMigrations are the migrations that bring a sqlite database up
+// to date, in order. The schema version of a database is the number
+// of migrations that have been applied to it. Once a migration has
+// been released, it must not be changed; add a new one instead.
+var sqliteMigrations = []string{
+	// 1: The initial schema. Databases from before migrations existed
+	// already have some of these tables, so they're created only if
+	// they don't exist.
+	`CREATE TABLE IF NOT EXISTS chars (id INTEGER PRIMARY KEY, login TIMESTAMP);
+	CREATE TABLE IF NOT EXISTS session (id TEXT PRIMARY KEY, valstr TEXT, valint INTEGER);
+	CREATE TABLE IF NOT EXISTS records (char INTEGER, world INTEGER, login TIMESTAMP, logout TIMESTAMP, flags INTEGER);
+	CREATE TABLE IF NOT EXISTS epochs (label TEXT, start TIMESTAMP, end TIMESTAMP, session TEXT);
+	CREATE TABLE IF NOT EXISTS coverage (start TIMESTAMP PRIMARY KEY, end TIMESTAMP);
+	CREATE TABLE IF NOT EXISTS outages (world INTEGER, start TIMESTAMP, end TIMESTAMP, logouts INTEGER);`,
+
+	// 2: Index characters by login time for OldestChar and records by
+	// logout time for queries over time ranges.
+	`CREATE INDEX chars_login ON chars (login);
+	CREATE INDEX records_logout ON records (logout);
+	CREATE INDEX outages_end ON outages (end);`,
+
+	// 3: Store the session as a whole. Rows in the old session table
+	// are converted the first time that the session is loaded.
+	`CREATE TABLE session_data (id INTEGER PRIMARY KEY CHECK (id = 1), data TEXT NOT NULL);`,
+
+	// 4: Daily rollups of pruned records.
+	`CREATE TABLE rollups (day TEXT, world INTEGER, sessions INTEGER, total INTEGER, longest INTEGER, PRIMARY KEY (day, world));`,
+
+	// 5: Cached character profiles.
+	`CREATE TABLE profiles (id INTEGER PRIMARY KEY, name TEXT, outfit_id INTEGER, outfit_alias TEXT, faction INTEGER, world INTEGER, battle_rank INTEGER, refreshed TIMESTAMP, missing BOOLEAN);`,
+
+	// 6: Records are read a page at a time in order of logout time with
+	// ties broken by character, so the index on only logout is
+	// replaced.
+	`DROP INDEX records_logout;
+	CREATE INDEX records_logout_char ON records (logout, char);`,
+}
+
+// sqliteVersion returns the schema version of a sqlite database,
+// creating the schema_version table if it doesn't exist yet.
+func sqliteVersion(db *sql.DB) (v int, err error) {
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER)`)
+	if err != nil {
+		return 0, err
+	}
+
+	var n sql.NullInt64
+	err = db.QueryRow(`SELECT max(version) FROM schema_version`).Scan(&n)
+	return int(n.Int64), err
+}
+
+// migrateSqlite applies migrations to a sqlite database until its
+// schema version is to. Each migration is applied in its own
+// transaction along with the update to the schema version, so a
+// failed migration leaves the database at the previous version.
+// Migrations can't be undone, so to can't be older than the database.
+func migrateSqlite(db *sql.DB, to int) error {
+	if to > len(sqliteMigrations) {
+		return fmt.Errorf("No such schema version: %v", to)
+	}
+
+	v, err := sqliteVersion(db)
+	if err != nil {
+		return err
+	}
+	if v > len(sqliteMigrations) {
+		return fmt.Errorf("Database schema version %v is newer than the latest known version %v", v, len(sqliteMigrations))
+	}
+	if to < v {
+		return fmt.Errorf("Database schema version %v is newer than %v, and downgrades aren't supported", v, to)
+	}
+
+	for ; v < to; v++ {
+		log.Printf("Migrating database to schema version %v...", v+1)
+
+		err := applySqliteMigration(db, v)
+		if err != nil {
+			return fmt.Errorf("Migration to schema version %v failed: %v", v+1, err)
+		}
+	}
+
+	return nil
+}
+
+// applySqliteMigration applies the migration at index i in
+// sqliteMigrations.
+func applySqliteMigration(db *sql.DB, i int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(sqliteMigrations[i])
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO schema_version (version) VALUES (?)`, i+1)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
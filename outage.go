@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recentOutages is the number of outages shown on the web interface.
+const recentOutages = 10
+
+// An Outage is a burst of logouts on a single world, such as when the
+// world goes down for maintenance or crashes.
+type Outage struct {
+	World int64 `json:"world"`
+
+	// Start and End are the times of the first and last logouts of the
+	// burst.
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	// Logouts is the number of logouts during the burst.
+	Logouts int `json:"logouts"`
+}
+
+// pendingRecord is a record that is waiting to see if it was part of
+// an outage before it's committed.
+type pendingRecord struct {
+	r     Record
+	added time.Time
+}
+
+// outageDetector detects outages by watching for the number of
+// logouts on a world in a period of time exceeding a limit. Because
+// an outage can't be detected until some of the logouts that were
+// part of it have already happened, records are held until they're
+// old enough that they couldn't be part of a newly detected outage.
+//
+// It is only safe to use from a single goroutine.
+type outageDetector struct {
+	rate rateFlag
+
+	worlds  map[int64]*worldLogouts
+	pending []pendingRecord
+}
+
+// worldLogouts tracks the recent logouts on a single world.
+type worldLogouts struct {
+	times []time.Time
+	cur   *Outage
+}
+
+func newOutageDetector(rate rateFlag) *outageDetector {
+	return &outageDetector{
+		rate:   rate,
+		worlds: make(map[int64]*worldLogouts),
+	}
+}
+
+// Enabled returns true if outages are being detected at all.
+func (od *outageDetector) Enabled() bool {
+	return (od.rate.n > 0) && (od.rate.per > 0)
+}
+
+// Logout adds a record to the detector. The record will be returned
+// by Ready once it's old enough, possibly flagged with recordOutage.
+// If the logout starts a new outage, it's returned.
+func (od *outageDetector) Logout(r Record, now time.Time) *Outage {
+	od.pending = append(od.pending, pendingRecord{r: r, added: now})
+
+	w := od.worlds[r.World]
+	if w == nil {
+		w = new(worldLogouts)
+		od.worlds[r.World] = w
+	}
+	w.times = append(w.times, r.Logout)
+	w.trim(r.Logout.Add(-od.rate.per))
+
+	if w.cur != nil {
+		w.cur.End = r.Logout
+		w.cur.Logouts++
+		od.flag(r.World, r.Logout)
+		return nil
+	}
+
+	if len(w.times) < od.rate.n {
+		return nil
+	}
+
+	w.cur = &Outage{
+		World:   r.World,
+		Start:   w.times[0],
+		End:     r.Logout,
+		Logouts: len(w.times),
+	}
+	od.flag(r.World, w.cur.Start)
+
+	return w.cur
+}
+
+// flag flags every pending record from world that logged out at or
+// after since as being part of an outage.
+func (od *outageDetector) flag(world int64, since time.Time) {
+	for i := range od.pending {
+		r := &od.pending[i].r
+		if (r.World == world) && !r.Logout.Before(since) {
+			r.Flags |= recordOutage
+		}
+	}
+}
+
+// Ready returns the pending records that have been waiting long
+// enough that they can no longer become part of an outage, removing
+// them from the detector.
+func (od *outageDetector) Ready(now time.Time) []Record {
+	var ready []Record
+	for len(od.pending) > 0 {
+		if now.Sub(od.pending[0].added) < od.rate.per {
+			break
+		}
+
+		ready = append(ready, od.pending[0].r)
+		od.pending = od.pending[1:]
+	}
+
+	return ready
+}
+
+// Pending returns the number of records being held by the detector.
+func (od *outageDetector) Pending() int {
+	return len(od.pending)
+}
+
+// Flush removes every pending record and every outage that is still
+// in progress from the detector and returns them, regardless of how
+// old they are. It's used when the tracker is stopping.
+func (od *outageDetector) Flush() ([]Record, []Outage) {
+	ready := make([]Record, 0, len(od.pending))
+	for _, p := range od.pending {
+		ready = append(ready, p.r)
+	}
+	od.pending = nil
+
+	var outages []Outage
+	for world, w := range od.worlds {
+		if w.cur != nil {
+			outages = append(outages, *w.cur)
+		}
+		delete(od.worlds, world)
+	}
+
+	return ready, outages
+}
+
+// Finished returns the outages that have ended, as of now, removing
+// them from the detector.
+func (od *outageDetector) Finished(now time.Time) []Outage {
+	var finished []Outage
+	for world, w := range od.worlds {
+		w.trim(now.Add(-od.rate.per))
+		if (w.cur != nil) && (len(w.times) < od.rate.n) {
+			finished = append(finished, *w.cur)
+			w.cur = nil
+		}
+		if (w.cur == nil) && (len(w.times) == 0) {
+			delete(od.worlds, world)
+		}
+	}
+
+	return finished
+}
+
+// trim removes logouts from before since.
+func (w *worldLogouts) trim(since time.Time) {
+	i := 0
+	for (i < len(w.times)) && w.times[i].Before(since) {
+		i++
+	}
+	w.times = w.times[i:]
+}
+
+// rateFlag is a number of events per a period of time, such as
+// "200/1m". It satisfies flag.Value.
+type rateFlag struct {
+	n   int
+	per time.Duration
+}
+
+func (f rateFlag) String() string {
+	return fmt.Sprintf("%v/%v", f.n, f.per)
+}
+
+func (f *rateFlag) Set(val string) error {
+	parts := strings.SplitN(val, "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("Invalid rate: %q", val)
+	}
+
+	n, err := strconv.ParseInt(parts[0], 10, 0)
+	if err != nil {
+		return err
+	}
+
+	per, err := time.ParseDuration(parts[1])
+	if err != nil {
+		return err
+	}
+
+	f.n = int(n)
+	f.per = per
+	return nil
+}
+
+// serveOutages returns a handler that serves the most recent outages
+// as JSON.
+func serveOutages(db DB) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		outages, err := db.Outages(recentOutages)
+		if err != nil {
+			log.Printf("Failed to get outages: %v", err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		type outage struct {
+			Outage
+			WorldName string `json:"worldname"`
+		}
+		named := make([]outage, 0, len(outages))
+		for _, o := range outages {
+			named = append(named, outage{Outage: o, WorldName: worldName(o.World)})
+		}
+
+		e := json.NewEncoder(rw)
+		err = e.Encode(named)
+		if err != nil {
+			log.Printf("Failed to write outages: %v", err)
+		}
+	})
+}
@@ -0,0 +1,763 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	_ "github.com/lib/pq"
+	"log"
+	"time"
+)
+
+// postgresSchema creates the tables used by postgresDB if they don't
+// already exist.
+var postgresSchema = []string{
+	`CREATE TABLE IF NOT EXISTS chars (id BIGINT PRIMARY KEY, login TIMESTAMPTZ NOT NULL)`,
+	// Characters are listed by login time with ties broken by ID, so
+	// the original index on only login is replaced.
+	`DROP INDEX IF EXISTS chars_login`,
+	`CREATE INDEX IF NOT EXISTS chars_login_id ON chars (login, id)`,
+
+	`CREATE TABLE IF NOT EXISTS records (char_id BIGINT NOT NULL, world BIGINT NOT NULL, login TIMESTAMPTZ NOT NULL, logout TIMESTAMPTZ NOT NULL, flags INTEGER NOT NULL)`,
+	// Records are read a page at a time in order of logout time with
+	// ties broken by character, so the original index on only logout is
+	// replaced.
+	`DROP INDEX IF EXISTS records_logout`,
+	`CREATE INDEX IF NOT EXISTS records_logout_char_id ON records (logout, char_id)`,
+
+	// The session is stored with typed columns across three tables: the
+	// statistics, which have a single row, the leaderboard, and the
+	// statistics of each world. Durations are in nanoseconds.
+	`CREATE TABLE IF NOT EXISTS session_stats (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		total_ns BIGINT NOT NULL,
+		total_num BIGINT NOT NULL,
+		noshort_ns BIGINT NOT NULL,
+		noshort_num BIGINT NOT NULL,
+		uncertain_ns BIGINT NOT NULL,
+		uncertain_num BIGINT NOT NULL,
+		longest_ns BIGINT NOT NULL,
+		longest_name TEXT NOT NULL,
+		shortest_long_ns BIGINT NOT NULL,
+		shortest_ns BIGINT NOT NULL,
+		epoch_start TIMESTAMPTZ NOT NULL,
+		gap_sessions BIGINT NOT NULL,
+		outages BIGINT NOT NULL,
+		outage_sessions BIGINT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS session_leaderboard (rank INTEGER PRIMARY KEY, char_id BIGINT NOT NULL, name TEXT NOT NULL, world BIGINT NOT NULL, duration_ns BIGINT NOT NULL, logout TIMESTAMPTZ NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS session_worlds (world BIGINT PRIMARY KEY, total_ns BIGINT NOT NULL, total_num BIGINT NOT NULL, sessions BIGINT NOT NULL, longest_ns BIGINT NOT NULL)`,
+
+	`CREATE TABLE IF NOT EXISTS epochs (label TEXT NOT NULL, started TIMESTAMPTZ NOT NULL, ended TIMESTAMPTZ NOT NULL, session JSONB NOT NULL)`,
+
+	`CREATE TABLE IF NOT EXISTS coverage (started TIMESTAMPTZ PRIMARY KEY, ended TIMESTAMPTZ NOT NULL)`,
+
+	`CREATE TABLE IF NOT EXISTS outages (world BIGINT NOT NULL, started TIMESTAMPTZ NOT NULL, ended TIMESTAMPTZ NOT NULL, logouts INTEGER NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS outages_ended ON outages (ended)`,
+
+	`CREATE TABLE IF NOT EXISTS rollups (day DATE NOT NULL, world BIGINT NOT NULL, sessions BIGINT NOT NULL, total BIGINT NOT NULL, longest BIGINT NOT NULL, PRIMARY KEY (day, world))`,
+
+	`CREATE TABLE IF NOT EXISTS profiles (id BIGINT PRIMARY KEY, name TEXT NOT NULL, outfit_id BIGINT NOT NULL, outfit_alias TEXT NOT NULL, faction BIGINT NOT NULL, world BIGINT NOT NULL, battle_rank INTEGER NOT NULL, refreshed TIMESTAMPTZ NOT NULL, missing BOOLEAN NOT NULL)`,
+}
+
+// postgresDB is a DB that stores everything in a PostgreSQL database.
+type postgresDB struct {
+	*sql.DB
+
+	add    *sql.Stmt
+	get    *sql.Stmt
+	oldest *sql.Stmt
+	rem    *sql.Stmt
+	num    *sql.Stmt
+	each   *sql.Stmt
+	asc    *sql.Stmt
+	desc   *sql.Stmt
+
+	radd  *sql.Stmt
+	reach *sql.Stmt
+	rpage *sql.Stmt
+
+	sadd *sql.Stmt
+	sget *sql.Stmt
+	ladd *sql.Stmt
+	lget *sql.Stmt
+	wadd *sql.Stmt
+	wget *sql.Stmt
+
+	eadd *sql.Stmt
+	eget *sql.Stmt
+
+	cadd *sql.Stmt
+	cget *sql.Stmt
+
+	oadd *sql.Stmt
+	oget *sql.Stmt
+
+	merge *sql.Stmt
+
+	padd *sql.Stmt
+	pget *sql.Stmt
+}
+
+func newpostgresDB(dsn string) (DB, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, q := range postgresSchema {
+		_, err = db.Exec(q)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pdb := &postgresDB{DB: db}
+	stmts := []struct {
+		stmt **sql.Stmt
+		q    string
+	}{
+		{&pdb.add, `INSERT INTO chars (id, login) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET login = EXCLUDED.login`},
+		{&pdb.get, `SELECT login FROM chars WHERE id = $1`},
+		{&pdb.oldest, `SELECT id, login FROM chars ORDER BY login LIMIT 1`},
+		{&pdb.rem, `DELETE FROM chars WHERE id = $1`},
+		{&pdb.num, `SELECT count(id) FROM chars`},
+		{&pdb.each, `SELECT id, login FROM chars`},
+		{&pdb.asc, `SELECT id, login FROM chars ORDER BY login, id`},
+		{&pdb.desc, `SELECT id, login FROM chars ORDER BY login DESC, id DESC`},
+
+		{&pdb.radd, `INSERT INTO records (char_id, world, login, logout, flags) VALUES ($1, $2, $3, $4, $5)`},
+		{&pdb.reach, `SELECT char_id, world, login, logout, flags FROM records`},
+		{&pdb.rpage, `SELECT char_id, world, login, logout, flags FROM records WHERE (logout, char_id) > ($1, $2) ORDER BY logout, char_id LIMIT $3`},
+
+		{&pdb.sadd, `INSERT INTO session_stats (id, total_ns, total_num, noshort_ns, noshort_num, uncertain_ns, uncertain_num, longest_ns, longest_name, shortest_long_ns, shortest_ns, epoch_start, gap_sessions, outages, outage_sessions)
+			VALUES (1, $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+			ON CONFLICT (id) DO UPDATE SET
+				total_ns = EXCLUDED.total_ns,
+				total_num = EXCLUDED.total_num,
+				noshort_ns = EXCLUDED.noshort_ns,
+				noshort_num = EXCLUDED.noshort_num,
+				uncertain_ns = EXCLUDED.uncertain_ns,
+				uncertain_num = EXCLUDED.uncertain_num,
+				longest_ns = EXCLUDED.longest_ns,
+				longest_name = EXCLUDED.longest_name,
+				shortest_long_ns = EXCLUDED.shortest_long_ns,
+				shortest_ns = EXCLUDED.shortest_ns,
+				epoch_start = EXCLUDED.epoch_start,
+				gap_sessions = EXCLUDED.gap_sessions,
+				outages = EXCLUDED.outages,
+				outage_sessions = EXCLUDED.outage_sessions`},
+		{&pdb.sget, `SELECT total_ns, total_num, noshort_ns, noshort_num, uncertain_ns, uncertain_num, longest_ns, longest_name, shortest_long_ns, shortest_ns, epoch_start, gap_sessions, outages, outage_sessions FROM session_stats WHERE id = 1`},
+		{&pdb.ladd, `INSERT INTO session_leaderboard (rank, char_id, name, world, duration_ns, logout) VALUES ($1, $2, $3, $4, $5, $6)`},
+		{&pdb.lget, `SELECT char_id, name, world, duration_ns, logout FROM session_leaderboard ORDER BY rank`},
+		{&pdb.wadd, `INSERT INTO session_worlds (world, total_ns, total_num, sessions, longest_ns) VALUES ($1, $2, $3, $4, $5)`},
+		{&pdb.wget, `SELECT world, total_ns, total_num, sessions, longest_ns FROM session_worlds`},
+
+		{&pdb.eadd, `INSERT INTO epochs (label, started, ended, session) VALUES ($1, $2, $3, $4)`},
+		{&pdb.eget, `SELECT label, started, ended, session FROM epochs ORDER BY ended`},
+
+		{&pdb.cadd, `INSERT INTO coverage (started, ended) VALUES ($1, $2) ON CONFLICT (started) DO UPDATE SET ended = EXCLUDED.ended`},
+		{&pdb.cget, `SELECT started, ended FROM coverage ORDER BY started`},
+
+		{&pdb.oadd, `INSERT INTO outages (world, started, ended, logouts) VALUES ($1, $2, $3, $4)`},
+		{&pdb.oget, `SELECT world, started, ended, logouts FROM outages ORDER BY ended DESC LIMIT $1`},
+
+		{&pdb.merge, `INSERT INTO rollups (day, world, sessions, total, longest) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (day, world) DO UPDATE SET
+				sessions = rollups.sessions + EXCLUDED.sessions,
+				total = rollups.total + EXCLUDED.total,
+				longest = GREATEST(rollups.longest, EXCLUDED.longest)`},
+
+		{&pdb.padd, `INSERT INTO profiles (id, name, outfit_id, outfit_alias, faction, world, battle_rank, refreshed, missing) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			ON CONFLICT (id) DO UPDATE SET
+				name = EXCLUDED.name,
+				outfit_id = EXCLUDED.outfit_id,
+				outfit_alias = EXCLUDED.outfit_alias,
+				faction = EXCLUDED.faction,
+				world = EXCLUDED.world,
+				battle_rank = EXCLUDED.battle_rank,
+				refreshed = EXCLUDED.refreshed,
+				missing = EXCLUDED.missing`},
+		{&pdb.pget, `SELECT name, outfit_id, outfit_alias, faction, world, battle_rank, refreshed, missing FROM profiles WHERE id = $1`},
+	}
+	for _, s := range stmts {
+		*s.stmt, err = db.Prepare(s.q)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = pdb.migrateLegacySession()
+	if err != nil {
+		return nil, err
+	}
+
+	return pdb, nil
+}
+
+// migrateLegacySession moves a session that was stored as JSON in the
+// session table, before the session had typed columns, into the typed
+// tables, and then drops the old table.
+func (db *postgresDB) migrateLegacySession() error {
+	var table sql.NullString
+	err := db.QueryRow(`SELECT to_regclass('session')::text`).Scan(&table)
+	if (err != nil) || !table.Valid {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var data []byte
+	err = tx.QueryRow(`SELECT data FROM session WHERE id = 1`).Scan(&data)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return err
+
+	default:
+		log.Println("Converting session to typed columns...")
+
+		s, err := unmarshalSession(data)
+		if err != nil {
+			return err
+		}
+
+		err = db.saveSession(tx, s)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`DROP TABLE session`)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *postgresDB) SetChar(id int64, login time.Time) error {
+	_, err := db.add.Exec(id, login)
+	return err
+}
+
+func (db *postgresDB) GetChar(id int64) (time.Time, bool, error) {
+	var login time.Time
+	err := db.get.QueryRow(id).Scan(&login)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return login, false, nil
+		}
+
+		return login, false, err
+	}
+
+	return login, true, nil
+}
+
+func (db *postgresDB) OldestChar() (id int64, t time.Time, err error) {
+	err = db.oldest.QueryRow().Scan(&id, &t)
+	if err == sql.ErrNoRows {
+		return 0, t, nil
+	}
+	return
+}
+
+func (db *postgresDB) ClearChars() error {
+	_, err := db.Exec(`TRUNCATE chars`)
+	return err
+}
+
+func (db *postgresDB) RemoveChar(id int64) error {
+	_, err := db.rem.Exec(id)
+	return err
+}
+
+func (db *postgresDB) NumChar() (n int) {
+	err := db.num.QueryRow().Scan(&n)
+	if err != nil {
+		log.Printf("Failed to get number of active characters: %v", err)
+	}
+
+	return n
+}
+
+func (db *postgresDB) EachChar(f func(int64, time.Time) error) error {
+	return eachCharRow(db.each, f)
+}
+
+func (db *postgresDB) EachCharByLogin(newest bool, f func(int64, time.Time) error) error {
+	if newest {
+		return eachCharRow(db.desc, f)
+	}
+
+	return eachCharRow(db.asc, f)
+}
+
+func (db *postgresDB) AddRecord(r Record) error {
+	_, err := db.radd.Exec(r.CharID, r.World, r.Login, r.Logout, r.Flags)
+	return err
+}
+
+func (db *postgresDB) EachRecord(f func(Record) error) error {
+	rows, err := db.reach.Query()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Record
+		err = rows.Scan(&r.CharID, &r.World, &r.Login, &r.Logout, &r.Flags)
+		if err != nil {
+			return err
+		}
+
+		err = f(r)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (db *postgresDB) RecordsAfter(logout time.Time, id int64, n int) ([]Record, error) {
+	rows, err := db.rpage.Query(logout, id, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := make([]Record, 0, n)
+	for rows.Next() {
+		var r Record
+		err = rows.Scan(&r.CharID, &r.World, &r.Login, &r.Logout, &r.Flags)
+		if err != nil {
+			return nil, err
+		}
+
+		page = append(page, r)
+	}
+
+	return page, rows.Err()
+}
+
+func (db *postgresDB) PruneRecords(before time.Time) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`DELETE FROM records WHERE logout < $1 RETURNING char_id, world, login, logout, flags`, before)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var n int
+	rs := make(rollups)
+	for rows.Next() {
+		var r Record
+		err = rows.Scan(&r.CharID, &r.World, &r.Login, &r.Logout, &r.Flags)
+		if err != nil {
+			return 0, err
+		}
+
+		rs.Add(r)
+		n++
+	}
+	err = rows.Err()
+	if err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	merge := tx.Stmt(db.merge)
+	for _, ru := range rs {
+		_, err = merge.Exec(ru.Day, ru.World, ru.Sessions, ru.Total, ru.Longest)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return n, tx.Commit()
+}
+
+func (db *postgresDB) MergeRollup(r Rollup) error {
+	_, err := db.merge.Exec(r.Day, r.World, r.Sessions, r.Total, r.Longest)
+	return err
+}
+
+func (db *postgresDB) EachRollup(f func(Rollup) error) error {
+	rows, err := db.Query(`SELECT to_char(day, 'YYYY-MM-DD'), world, sessions, total, longest FROM rollups ORDER BY day, world`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Rollup
+		err = rows.Scan(&r.Day, &r.World, &r.Sessions, &r.Total, &r.Longest)
+		if err != nil {
+			return err
+		}
+
+		err = f(r)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (db *postgresDB) RollupsAfter(day string, world int64, n int) ([]Rollup, error) {
+	// The first page is read with an empty day, which isn't a valid
+	// date.
+	if day == "" {
+		day = "-infinity"
+	}
+
+	rows, err := db.Query(`SELECT to_char(day, 'YYYY-MM-DD'), world, sessions, total, longest FROM rollups WHERE (day, world) > ($1::date, $2) ORDER BY day, world LIMIT $3`, day, world, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := make([]Rollup, 0, n)
+	for rows.Next() {
+		var r Rollup
+		err = rows.Scan(&r.Day, &r.World, &r.Sessions, &r.Total, &r.Longest)
+		if err != nil {
+			return nil, err
+		}
+
+		page = append(page, r)
+	}
+
+	return page, rows.Err()
+}
+
+func (db *postgresDB) LoadSession() (s Session, err error) {
+	defer func() {
+		s.db = db
+	}()
+
+	var epochStart time.Time
+	err = db.sget.QueryRow().Scan(
+		&s.Total.Cur, &s.Total.Num,
+		&s.NoShort.Cur, &s.NoShort.Num,
+		&s.Uncertain.Cur, &s.Uncertain.Num,
+		&s.Longest, &s.LongestName,
+		&s.ShortestLong, &s.Shortest,
+		&epochStart,
+		&s.GapSessions, &s.Outages, &s.OutageSessions,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return s, errNoSession
+		}
+
+		return s, err
+	}
+	s.EpochStart = unixTime(epochStart.Unix())
+
+	rows, err := db.lget.Query()
+	if err != nil {
+		return s, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e LeaderboardEntry
+		err = rows.Scan(&e.CharID, &e.Name, &e.World, &e.Duration, &e.Logout)
+		if err != nil {
+			return s, err
+		}
+		s.Leaderboard = append(s.Leaderboard, e)
+	}
+	err = rows.Err()
+	if err != nil {
+		return s, err
+	}
+
+	rows, err = db.wget.Query()
+	if err != nil {
+		return s, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var w WorldStats
+		err = rows.Scan(&id, &w.Total.Cur, &w.Total.Num, &w.Sessions, &w.Longest)
+		if err != nil {
+			return s, err
+		}
+		*s.world(id) = w
+	}
+
+	return s, rows.Err()
+}
+
+func (db *postgresDB) SaveSession(s Session) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = db.saveSession(tx, s)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// saveSession replaces the session stored in the typed session tables
+// with s as part of tx.
+func (db *postgresDB) saveSession(tx *sql.Tx, s Session) error {
+	_, err := tx.Stmt(db.sadd).Exec(
+		s.Total.Cur, s.Total.Num,
+		s.NoShort.Cur, s.NoShort.Num,
+		s.Uncertain.Cur, s.Uncertain.Num,
+		s.Longest, s.LongestName,
+		s.ShortestLong, s.Shortest,
+		time.Unix(int64(s.EpochStart), 0),
+		s.GapSessions, s.Outages, s.OutageSessions,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM session_leaderboard`)
+	if err != nil {
+		return err
+	}
+	ladd := tx.Stmt(db.ladd)
+	for i, e := range s.Leaderboard {
+		_, err = ladd.Exec(i, e.CharID, e.Name, e.World, e.Duration, e.Logout)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`DELETE FROM session_worlds`)
+	if err != nil {
+		return err
+	}
+	wadd := tx.Stmt(db.wadd)
+	for id, w := range s.Worlds {
+		_, err = wadd.Exec(id, w.Total.Cur, w.Total.Num, w.Sessions, w.Longest)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (db *postgresDB) SaveEpoch(epoch Epoch) error {
+	data, err := json.Marshal(epoch.Session)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.eadd.Exec(epoch.Label, epoch.Start, epoch.End, string(data))
+	return err
+}
+
+func (db *postgresDB) Epochs() (epochs []Epoch, err error) {
+	rows, err := db.eget.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var epoch Epoch
+		var data []byte
+		err = rows.Scan(&epoch.Label, &epoch.Start, &epoch.End, &data)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal(data, &epoch.Session)
+		if err != nil {
+			return nil, err
+		}
+
+		epochs = append(epochs, epoch)
+	}
+
+	return epochs, rows.Err()
+}
+
+func (db *postgresDB) SaveInterval(i Interval) error {
+	_, err := db.cadd.Exec(i.Start, i.End)
+	return err
+}
+
+func (db *postgresDB) Intervals() (intervals []Interval, err error) {
+	rows, err := db.cget.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i Interval
+		err = rows.Scan(&i.Start, &i.End)
+		if err != nil {
+			return nil, err
+		}
+
+		intervals = append(intervals, i)
+	}
+
+	return intervals, rows.Err()
+}
+
+func (db *postgresDB) AddOutage(o Outage) error {
+	_, err := db.oadd.Exec(o.World, o.Start, o.End, o.Logouts)
+	return err
+}
+
+func (db *postgresDB) Outages(n int) (outages []Outage, err error) {
+	rows, err := db.oget.Query(n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var o Outage
+		err = rows.Scan(&o.World, &o.Start, &o.End, &o.Logouts)
+		if err != nil {
+			return nil, err
+		}
+
+		outages = append(outages, o)
+	}
+
+	return outages, rows.Err()
+}
+
+func (db *postgresDB) PruneOutages(before time.Time) (int, error) {
+	res, err := db.Exec(`DELETE FROM outages WHERE ended < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (db *postgresDB) GetProfile(id int64) (Profile, bool, error) {
+	p := Profile{ID: id}
+	err := db.pget.QueryRow(id).Scan(&p.Name, &p.OutfitID, &p.OutfitAlias, &p.Faction, &p.World, &p.BattleRank, &p.Refreshed, &p.Missing)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return p, false, nil
+		}
+
+		return p, false, err
+	}
+
+	return p, true, nil
+}
+
+func (db *postgresDB) SaveProfile(p Profile) error {
+	_, err := db.padd.Exec(p.ID, p.Name, p.OutfitID, p.OutfitAlias, p.Faction, p.World, p.BattleRank, p.Refreshed, p.Missing)
+	return err
+}
+
+func (db *postgresDB) EachProfile(f func(Profile) error) error {
+	return eachProfileRow(db.DB, `SELECT id, name, outfit_id, outfit_alias, faction, world, battle_rank, refreshed, missing FROM profiles`, f)
+}
+
+// Import imports an archive in a single transaction.
+func (db *postgresDB) Import(a *archive, s *Session) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if s != nil {
+		err = db.saveSession(tx, *s)
+		if err != nil {
+			return fmt.Errorf("Failed to save session: %v", err)
+		}
+	}
+
+	add := tx.Stmt(db.add)
+	for _, c := range a.Chars {
+		_, err = add.Exec(c.ID, c.Login)
+		if err != nil {
+			return fmt.Errorf("Failed to add character %v: %v", c.ID, err)
+		}
+	}
+
+	radd := tx.Stmt(db.radd)
+	for _, r := range a.Records {
+		_, err = radd.Exec(r.CharID, r.World, r.Login, r.Logout, r.Flags)
+		if err != nil {
+			return fmt.Errorf("Failed to add record: %v", err)
+		}
+	}
+
+	merge := tx.Stmt(db.merge)
+	for _, r := range a.Rollups {
+		_, err = merge.Exec(r.Day, r.World, r.Sessions, r.Total, r.Longest)
+		if err != nil {
+			return fmt.Errorf("Failed to add rollup: %v", err)
+		}
+	}
+
+	eadd := tx.Stmt(db.eadd)
+	for _, epoch := range a.Epochs {
+		data, err := json.Marshal(epoch.Session)
+		if err != nil {
+			return err
+		}
+
+		_, err = eadd.Exec(epoch.Label, epoch.Start, epoch.End, string(data))
+		if err != nil {
+			return fmt.Errorf("Failed to add epoch %q: %v", epoch.Label, err)
+		}
+	}
+
+	cadd := tx.Stmt(db.cadd)
+	for _, i := range a.Intervals {
+		_, err = cadd.Exec(i.Start, i.End)
+		if err != nil {
+			return fmt.Errorf("Failed to add coverage: %v", err)
+		}
+	}
+
+	oadd := tx.Stmt(db.oadd)
+	for _, o := range a.Outages {
+		_, err = oadd.Exec(o.World, o.Start, o.End, o.Logouts)
+		if err != nil {
+			return fmt.Errorf("Failed to add outage: %v", err)
+		}
+	}
+
+	padd := tx.Stmt(db.padd)
+	for _, p := range a.Profiles {
+		_, err = padd.Exec(p.ID, p.Name, p.OutfitID, p.OutfitAlias, p.Faction, p.World, p.BattleRank, p.Refreshed, p.Missing)
+		if err != nil {
+			return fmt.Errorf("Failed to add profile of %v: %v", p.ID, err)
+		}
+	}
+
+	return tx.Commit()
+}
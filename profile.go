@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// profileQueue is the maximum number of profiles that can be waiting
+// to be refreshed in the background. If the queue is full, stale
+// profiles are still used, but aren't queued.
+const profileQueue = 100
+
+// profileBatch is the maximum number of profiles looked up in a single
+// request to Census by GetMany.
+const profileBatch = 100
+
+// profileMemory is the maximum number of recently used profiles that
+// are also kept in memory for Peek.
+const profileMemory = 10000
+
+// A Profile is the information about a character that's cached from
+// Census.
+type Profile struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	OutfitID    int64  `json:"outfit_id"`
+	OutfitAlias string `json:"outfit_alias"`
+	Faction     int64  `json:"faction"`
+	World       int64  `json:"world"`
+	BattleRank  int    `json:"battle_rank"`
+
+	// Refreshed is when the profile was last fetched from Census.
+	Refreshed time.Time `json:"refreshed"`
+
+	// Missing is true if Census said that the character doesn't
+	// exist. Missing profiles are cached so that characters that
+	// don't exist aren't looked up over and over.
+	Missing bool `json:"missing"`
+}
+
+// DisplayName returns the character's name, prefixed by its outfit's
+// alias in brackets if it has one.
+func (p Profile) DisplayName() string {
+	buf := bytes.NewBuffer(make([]byte, 0, len(p.Name)+len(p.OutfitAlias)+3))
+	if p.OutfitAlias != "" {
+		buf.WriteByte('[')
+		buf.WriteString(p.OutfitAlias)
+		buf.WriteString("] ")
+	}
+	buf.WriteString(p.Name)
+
+	return buf.String()
+}
+
+// profiles is the profile cache used by getName. It's nil until main
+// creates it, in which case getName goes straight to Census.
+var profiles *profileCache
+
+// profileCache looks up character profiles, caching them in a DB so
+// that they survive restarts and Census being unavailable. Profiles
+// older than ttl are still used, but are refreshed in the background.
+// Missing characters are cached for missing before they're looked up
+// again.
+type profileCache struct {
+	db      DB
+	ttl     time.Duration
+	missing time.Duration
+
+	refresh chan int64
+
+	m      sync.Mutex
+	queued map[int64]bool
+
+	// closed is set by Close, after which nothing more is queued. It's
+	// guarded by m so that refresh is never sent to after it's closed.
+	closed bool
+
+	// recent holds recently used profiles for Peek. Once it's full, an
+	// arbitrary profile is dropped to make room for each new one.
+	recent map[int64]Profile
+
+	done chan struct{}
+}
+
+func newProfileCache(db DB, ttl, missing time.Duration) *profileCache {
+	pc := &profileCache{
+		db:      db,
+		ttl:     ttl,
+		missing: missing,
+
+		refresh: make(chan int64, profileQueue),
+		queued:  make(map[int64]bool),
+		recent:  make(map[int64]Profile),
+
+		done: make(chan struct{}),
+	}
+	go pc.run()
+
+	return pc
+}
+
+// createProfileCache creates a profile cache for db configured by the
+// -profiles flag.
+func createProfileCache(db DB) (*profileCache, error) {
+	ttl, err := time.ParseDuration(flags.profiles["ttl"])
+	if err != nil {
+		return nil, fmt.Errorf("Bad ttl option: %v", err)
+	}
+
+	missing, err := time.ParseDuration(flags.profiles["missing"])
+	if err != nil {
+		return nil, fmt.Errorf("Bad missing option: %v", err)
+	}
+
+	return newProfileCache(db, ttl, missing), nil
+}
+
+// Get returns the profile of the character with the given ID. If the
+// character doesn't exist, a noSuchCharError is returned.
+func (pc *profileCache) Get(id int64) (Profile, error) {
+	p, ok, err := pc.cached(id)
+	if ok {
+		return p, err
+	}
+
+	return pc.fetch(id)
+}
+
+// GetMany returns the profiles of the characters with the given IDs.
+// Profiles that aren't cached are looked up in Census in batches of
+// profileBatch instead of one at a time. Characters that don't exist
+// are left out of the returned map. If a lookup fails, the profiles
+// found so far are returned along with the error.
+func (pc *profileCache) GetMany(ids []int64) (map[int64]Profile, error) {
+	ps := make(map[int64]Profile, len(ids))
+
+	var misses []int64
+	for _, id := range ids {
+		p, ok, err := pc.cached(id)
+		if !ok {
+			misses = append(misses, id)
+			continue
+		}
+		if err == nil {
+			ps[id] = p
+		}
+	}
+
+	for len(misses) > 0 {
+		n := len(misses)
+		if n > profileBatch {
+			n = profileBatch
+		}
+
+		err := pc.fetchMany(misses[:n], ps)
+		if err != nil {
+			return ps, err
+		}
+		misses = misses[n:]
+	}
+
+	return ps, nil
+}
+
+// Peek returns the profile of the character with the given ID if it's
+// been used recently, without touching the database or Census. ok is
+// false if it hasn't been, or if the character doesn't exist.
+func (pc *profileCache) Peek(id int64) (p Profile, ok bool) {
+	pc.m.Lock()
+	defer pc.m.Unlock()
+
+	p, ok = pc.recent[id]
+	return p, ok && !p.Missing
+}
+
+// remember adds a profile to the ones that Peek can return.
+func (pc *profileCache) remember(p Profile) {
+	pc.m.Lock()
+	defer pc.m.Unlock()
+
+	if _, ok := pc.recent[p.ID]; !ok && (len(pc.recent) >= profileMemory) {
+		for id := range pc.recent {
+			delete(pc.recent, id)
+			break
+		}
+	}
+	pc.recent[p.ID] = p
+}
+
+// cached looks up a profile in the cache. ok is false if the profile
+// has to be looked up in Census. If the character is cached as not
+// existing, a noSuchCharError is returned. Stale profiles are returned
+// as is and queued to be refreshed.
+func (pc *profileCache) cached(id int64) (p Profile, ok bool, err error) {
+	p, ok, err = pc.db.GetProfile(id)
+	if err != nil {
+		// Not a fatal error. It's just looked up in Census instead.
+		log.Printf("Failed to get cached profile of %v: %v", id, err)
+	}
+
+	if ok {
+		pc.remember(p)
+
+		age := time.Since(p.Refreshed)
+		switch {
+		case p.Missing && (age < pc.missing):
+			metricProfileLookups.WithLabelValues("missing").Inc()
+			return p, true, noSuchCharError(id)
+
+		case !p.Missing:
+			if age >= pc.ttl {
+				metricProfileLookups.WithLabelValues("stale").Inc()
+				pc.queue(id)
+			} else {
+				metricProfileLookups.WithLabelValues("hit").Inc()
+			}
+			return p, true, nil
+		}
+	}
+
+	metricProfileLookups.WithLabelValues("miss").Inc()
+	return p, false, nil
+}
+
+// queue queues a profile to be refreshed in the background, unless
+// it's already queued or the queue is full. It returns false if the
+// queue is full or the cache has been closed.
+func (pc *profileCache) queue(id int64) bool {
+	pc.m.Lock()
+	defer pc.m.Unlock()
+
+	if pc.closed {
+		return false
+	}
+	if pc.queued[id] {
+		return true
+	}
+
+	select {
+	case pc.refresh <- id:
+		pc.queued[id] = true
+		return true
+	default:
+		return false
+	}
+}
+
+// Refresh queues a profile to be refreshed in the background whether
+// or not it's stale. It returns false if the queue is full.
+func (pc *profileCache) Refresh(id int64) bool {
+	return pc.queue(id)
+}
+
+// Queued returns the number of profiles waiting to be refreshed.
+func (pc *profileCache) Queued() int {
+	return len(pc.refresh)
+}
+
+// fetch looks up a profile in Census and caches the result. If the
+// lookup fails for any reason other than the character not existing,
+// nothing is cached.
+func (pc *profileCache) fetch(id int64) (Profile, error) {
+	p, err := fetchProfile(id)
+	if err != nil {
+		if _, ok := err.(noSuchCharError); !ok {
+			return p, err
+		}
+
+		p = Profile{ID: id, Missing: true}
+	}
+	p.Refreshed = time.Now()
+	pc.remember(p)
+
+	serr := pc.db.SaveProfile(p)
+	if serr != nil {
+		log.Printf("Failed to cache profile of %v: %v", id, serr)
+	}
+
+	return p, err
+}
+
+// fetchMany looks up several profiles in Census with a single
+// request, caches the results, and adds the profiles of the characters
+// that exist to ps.
+func (pc *profileCache) fetchMany(ids []int64, ps map[int64]Profile) error {
+	found, err := fetchProfiles(ids)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, id := range ids {
+		p, ok := found[id]
+		if !ok {
+			p = Profile{ID: id, Missing: true}
+		}
+		p.Refreshed = now
+		pc.remember(p)
+
+		err := pc.db.SaveProfile(p)
+		if err != nil {
+			log.Printf("Failed to cache profile of %v: %v", id, err)
+		}
+
+		if !p.Missing {
+			ps[id] = p
+		}
+	}
+
+	return nil
+}
+
+// Close stops refreshing profiles in the background, waiting for the
+// current refresh, if any, to finish. Profiles can still be looked up
+// afterwards, such as by requests that outlast a shutdown, but stale
+// ones aren't refreshed.
+func (pc *profileCache) Close() {
+	pc.m.Lock()
+	if !pc.closed {
+		pc.closed = true
+		close(pc.refresh)
+	}
+	pc.m.Unlock()
+
+	<-pc.done
+}
+
+// run refreshes queued profiles until the cache is closed.
+func (pc *profileCache) run() {
+	defer close(pc.done)
+
+	for id := range pc.refresh {
+		_, err := pc.fetch(id)
+		if err != nil {
+			if _, ok := err.(noSuchCharError); !ok {
+				log.Printf("Failed to refresh profile of %v: %v", id, err)
+			}
+		}
+
+		pc.m.Lock()
+		delete(pc.queued, id)
+		pc.m.Unlock()
+	}
+}
@@ -1,29 +1,39 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"github.com/DeedleFake/census/ps2/events"
 	"log"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 )
 
+// shutdownTimeout is how long in-progress requests are given to
+// finish when the tracker is stopping.
+const shutdownTimeout = 10 * time.Second
+
 var (
 	// session can be used to get a copy of the current session.
 	session = make(chan Session)
+
+	// epochs is used to ask coord to archive the current session and
+	// start a new one. See newEpoch.
+	epochs = make(chan epochRequest)
 )
 
 // coord coordinates the session, updating it properly when login and
-// logout events occur, and sending a copy of the session down the
-// session channel when it's requested.
-func coord(logins <-chan *events.PlayerLogin, logouts <-chan *events.PlayerLogout, errors <-chan error) {
-	db, err := createDB()
-	if err != nil {
-		log.Fatalf("Failed to create database: %v", err)
-	}
-	defer db.Close()
-
+// logout events occur, sending a copy of the session down the session
+// channel when it's requested, and performing actions requested by the
+// admin API.
+//
+// Once logins, logouts, and errors have all been closed and drained,
+// coord commits any records that are still being held by the outage
+// detector, saves the session one last time, and returns.
+func coord(db DB, logins <-chan *events.PlayerLogin, logouts <-chan *events.PlayerLogout, errors <-chan error) {
 	log.Println("Loading session...")
 	s, err := db.LoadSession()
 	if err != nil {
@@ -31,32 +41,135 @@ func coord(logins <-chan *events.PlayerLogin, logouts <-chan *events.PlayerLogou
 		log.Println("Creating new session...")
 	}
 	s.Runtime = timeDiff(time.Now())
-	if s.ShortestLong == 0 {
-		s.ShortestLong = jsonDuration(1000 * time.Hour)
-	}
-	if s.Shortest == 0 {
-		s.Shortest = jsonDuration(1000 * time.Hour)
+	initSession(&s)
+	observeAverages(&s)
+
+	cov, err := loadCoverage(db)
+	if err != nil {
+		log.Printf("Failed to load coverage: %v", err)
 	}
 
 	copySession := func() Session {
-		s := s
+		s := s.clone()
 		s.NumChars = db.NumChar()
+		s.Coverage = cov.Percent(time.Now())
 
 		return s
 	}
 
 	var oldest int64
 
-	for {
+	// changed is true if the session has changed since it was last
+	// published to live clients.
+	changed := false
+	var lastPublish time.Time
+
+	// Sessions that start during the warm-up period after the tracker
+	// starts or reconnects are uncertain. uncertain keeps track of which
+	// active sessions those are.
+	uncertainUntil := time.Now().Add(getSettings().Warmup)
+	uncertain := make(map[int64]bool)
+
+	od := newOutageDetector(flags.outage)
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	endOutage := func(o Outage) {
+		log.Printf("Outage on %v ended: %v logouts between %v and %v", worldName(o.World), o.Logouts, o.Start, o.End)
+		s.Outages++
+
+		err := db.AddOutage(o)
+		if err != nil {
+			log.Printf("Failed to save outage: %v", err)
+		}
+	}
+
+	// replaceOldest finds the new oldest active session once the
+	// current one has ended.
+	replaceOldest := func() {
+		done := observeDB("oldest_char")
+		id, t, err := db.OldestChar()
+		done()
+		if err != nil {
+			log.Printf("Failed to get oldest char: %v", err)
+		}
+
+		log.Printf("Previous oldest session was %q (%v) and lasted %v", s.OldestName, oldest, s.Oldest.String())
+		oldest = id
+		s.Oldest = timeDiff(t)
+		s.OldestName, err = getName(id)
+		if err != nil {
+			log.Printf("Failed to get name for %v: %v", id, err)
+		}
+		log.Printf("New oldest session is %q (%v) since %v", s.OldestName, id, time.Time(s.Oldest))
+		live.Publish("oldest", liveOldest{Name: s.OldestName, Since: time.Time(s.Oldest)})
+		changed = true
+	}
+
+	// evict stops tracking a character without recording its session.
+	evict := func(id int64) error {
+		_, ok, err := db.GetChar(id)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return notOnlineError(id)
+		}
+
+		err = db.RemoveChar(id)
+		if err != nil {
+			return err
+		}
+		delete(uncertain, id)
+		observeOnline(id, 0, true)
+		log.Printf("Evicted %v", id)
+
+		if id == oldest {
+			replaceOldest()
+		}
+		return nil
+	}
+
+	// queues returns the depths of the internal queues.
+	queues := func() map[string]queueDepth {
+		clients, backlog := live.Backlog()
+		q := map[string]queueDepth{
+			"online_metrics":  {Len: len(onlineUpdates), Cap: cap(onlineUpdates)},
+			"profile_refresh": {Len: profiles.Queued(), Cap: profileQueue},
+			"outage_pending":  {Len: od.Pending()},
+			"uncertain":       {Len: len(uncertain)},
+			"live_clients":    {Len: clients},
+			"live_backlog":    {Len: backlog, Cap: liveBuffer},
+		}
+		if p, ok := db.(pendinger); ok {
+			q["db_pending"] = queueDepth{Len: p.Pending()}
+		}
+
+		return q
+	}
+
+	for (logins != nil) || (logouts != nil) || (errors != nil) {
 		select {
-		case ev := <-logins:
+		case ev, ok := <-logins:
+			if !ok {
+				logins = nil
+				continue
+			}
+
 			t := time.Unix(ev.Timestamp, 0)
 
+			done := observeDB("set_char")
 			err := db.SetChar(ev.CharacterID, t)
+			done()
 			if err != nil {
 				// Not a fatal error.
 				log.Printf("Failed to add %v to DB: %v", ev.CharacterID, err)
 			}
+			observeOnline(ev.CharacterID, ev.WorldID, false)
+
+			if (s.Err != nil) || t.Before(uncertainUntil) {
+				uncertain[ev.CharacterID] = true
+			}
 
 			if oldest == 0 {
 				oldest = ev.CharacterID
@@ -67,78 +180,306 @@ func coord(logins <-chan *events.PlayerLogin, logouts <-chan *events.PlayerLogou
 					log.Printf("Failed to get name for %v: %v", ev.CharacterID, err)
 				}
 				log.Printf("New oldest session is %q (%v) since %v", s.OldestName, ev.CharacterID, time.Time(s.Oldest))
+				live.Publish("oldest", liveOldest{Name: s.OldestName, Since: time.Time(s.Oldest)})
+				changed = true
 			}
 
-		case ev := <-logouts:
+		case ev, ok := <-logouts:
+			if !ok {
+				logouts = nil
+				continue
+			}
+
+			done := observeDB("get_char")
 			in, ok, err := db.GetChar(ev.CharacterID)
+			done()
 			if err != nil {
 				log.Printf("Failed to get %v from DB: %v", ev.CharacterID, err)
 				continue
 			}
 			if ok {
-				d := time.Unix(ev.Timestamp, 0).Sub(in)
-
-				s.Total.Update(d)
-				if d > flags.short {
-					s.NoShort.Update(d)
-
-					if d < time.Duration(s.ShortestLong) {
-						s.ShortestLong = jsonDuration(d)
-					}
+				var rf recordFlag
+				if uncertain[ev.CharacterID] {
+					rf |= recordUncertain
+					delete(uncertain, ev.CharacterID)
+				}
+				if cov.OverlapsGap(in) {
+					rf |= recordGap
 				}
 
-				if d > time.Duration(s.Longest) {
-					s.Longest = jsonDuration(d)
-
-					s.LongestName, err = getName(ev.CharacterID)
-					if err != nil {
-						log.Printf("Failed to get name for %v: %v", ev.CharacterID, err)
-					}
-					log.Printf("New longest session record is held by %q (%v) at %v", s.LongestName, ev.CharacterID, time.Duration(s.Longest))
+				r := Record{
+					CharID: ev.CharacterID,
+					World:  ev.WorldID,
+					Login:  in,
+					Logout: time.Unix(ev.Timestamp, 0),
+					Flags:  rf,
 				}
-				if d < time.Duration(s.Shortest) {
-					s.Shortest = jsonDuration(d)
+				if od.Enabled() {
+					if o := od.Logout(r, time.Now()); o != nil {
+						log.Printf("Outage detected on %v: %v logouts since %v", worldName(o.World), o.Logouts, o.Start)
+					}
+				} else {
+					commitRecord(db, &s, r)
+					changed = true
 				}
 
+				done := observeDB("remove_char")
 				err := db.RemoveChar(ev.CharacterID)
+				done()
 				if err != nil {
 					log.Printf("Failed to remove %v from DB: %v", ev.CharacterID, err)
 				}
+				observeOnline(ev.CharacterID, ev.WorldID, true)
 
 				if ev.CharacterID == oldest {
-					id, t, err := db.OldestChar()
-					if err != nil {
-						log.Printf("Failed to get oldest char: %v", err)
-					}
-
-					log.Printf("Previous oldest session was %q (%v) and lasted %v", s.OldestName, oldest, s.Oldest.String())
-					oldest = id
-					s.Oldest = timeDiff(t)
-					s.OldestName, err = getName(id)
-					if err != nil {
-						log.Printf("Failed to get name for %v: %v", id, err)
-					}
-					log.Printf("New oldest session is %q (%v) since %v", s.OldestName, id, time.Time(s.Oldest))
+					replaceOldest()
 				}
 			}
 
-		case err := <-errors:
+		case err, ok := <-errors:
+			if !ok {
+				errors = nil
+				continue
+			}
+
+			now := time.Now()
+			if (s.Err != nil) && (err == nil) {
+				warmup := getSettings().Warmup
+				log.Printf("Connection recovered. Sessions starting in the next %v are uncertain.", warmup)
+				metricReconnects.Inc()
+				uncertainUntil = now.Add(warmup)
+			}
 			s.Err = err
+			changed = true
+
+			if err != nil {
+				cov.Disconnect(now)
+				break
+			}
+			cov.Connect(now)
+			cov.Update(now)
+
+		case now := <-tick.C:
+			reportCoord(now)
+
+			for _, r := range od.Ready(now) {
+				commitRecord(db, &s, r)
+				changed = true
+			}
+
+			for _, o := range od.Finished(now) {
+				endOutage(o)
+				changed = true
+			}
+
+			// Changes are published at most once per tick, as there can
+			// be many of them per second.
+			if live.Active() && (changed || (now.Sub(lastPublish) >= liveInterval)) {
+				live.Publish("session", copySession())
+				changed = false
+				lastPublish = now
+			}
+
+		case req := <-epochs:
+			fresh, err := archiveSession(db, s, req.label)
+			if err == nil {
+				log.Printf("Archived session as epoch %q", req.label)
+				s = fresh
+				err = s.Save()
+				changed = true
+			}
+			req.err <- err
+
+		case req := <-admin:
+			var res adminResult
+			switch req.action {
+			case adminSave:
+				log.Println("Saving session...")
+				res.err = s.Save()
+				reportSave(res.err)
+				res.v = map[string]time.Time{"saved": time.Now()}
+
+			case adminReset:
+				log.Println("Resetting statistics...")
+				s = freshSession(s, time.Now())
+				observeAverages(&s)
+				res.err = s.Save()
+				res.v = map[string]interface{}{"epoch_start": time.Unix(int64(s.EpochStart), 0)}
+				changed = true
+
+			case adminReload:
+				var set settings
+				set, res.err = reloadSettings()
+				if res.err == nil {
+					log.Printf("Reloaded settings from %q", flags.config)
+				}
+				res.v = newAdminSettings(set)
+
+			case adminEvict:
+				res.err = evict(req.id)
+				res.v = map[string]int64{"evicted": req.id}
+
+			case adminRefresh:
+				ids := []int64{req.id}
+				if req.id == 0 {
+					ids = s.namedChars(oldest)
+				}
+
+				var queued, dropped int
+				for _, id := range ids {
+					if profiles.Refresh(id) {
+						queued++
+					} else {
+						dropped++
+					}
+				}
+				res.v = map[string]int{"queued": queued, "dropped": dropped}
+
+			case adminQueues:
+				res.v = queues()
+			}
+			req.res <- res
 
 		case session <- copySession():
 		}
 	}
+
+	log.Println("Event streams closed. Committing pending records...")
+	records, outages := od.Flush()
+	for _, r := range records {
+		commitRecord(db, &s, r)
+	}
+	for _, o := range outages {
+		endOutage(o)
+	}
+	cov.Disconnect(time.Now())
+
+	log.Println("Saving session...")
+	err = s.Save()
+	reportSave(err)
+	if err != nil {
+		log.Printf("Failed to save session: %v", err)
+	}
+}
+
+// commitRecord saves r to db and updates the statistics in s with it.
+func commitRecord(db DB, s *Session, r Record) {
+	done := observeDB("add_record")
+	err := db.AddRecord(r)
+	done()
+	if err != nil {
+		log.Printf("Failed to record session of %v: %v", r.CharID, err)
+	}
+
+	d := r.Duration()
+	if r.Flags&recordGap != 0 {
+		s.GapSessions++
+	}
+	if r.Flags&recordOutage != 0 {
+		s.OutageSessions++
+	}
+	counted := updateAverages(s, d, r.Flags)
+	metricSessionLength.Observe(d.Seconds())
+	observeAverages(s)
+	live.Publish("record", liveRecord{
+		Record:    r,
+		WorldName: worldName(r.World),
+		Duration:  jsonDuration(d),
+	})
+
+	w := s.world(r.World)
+	w.Sessions++
+	if counted {
+		w.Total.Update(d)
+	}
+	if d > time.Duration(w.Longest) {
+		w.Longest = jsonDuration(d)
+	}
+
+	if s.qualifies(d) {
+		name, err := getName(r.CharID)
+		if err != nil {
+			log.Printf("Failed to get name for %v: %v", r.CharID, err)
+		}
+
+		s.addLeader(LeaderboardEntry{
+			CharID:   r.CharID,
+			Name:     name,
+			World:    r.World,
+			Duration: jsonDuration(d),
+			Logout:   r.Logout,
+		})
+	}
+
+	if d > time.Duration(s.Longest) {
+		s.Longest = jsonDuration(d)
+
+		s.LongestName, err = getName(r.CharID)
+		if err != nil {
+			log.Printf("Failed to get name for %v: %v", r.CharID, err)
+		}
+		log.Printf("New longest session record is held by %q (%v) at %v", s.LongestName, r.CharID, time.Duration(s.Longest))
+	}
+	if d < time.Duration(s.Shortest) {
+		s.Shortest = jsonDuration(d)
+	}
+}
+
+// updateAverages updates the averages in s with a session that
+// lasted for d. Uncertain sessions are averaged separately, and only
+// count towards the main averages if the -uncertain flag was given.
+// Sessions ended by outages are excluded entirely if the -nooutages
+// flag was given. It returns true if the session counted towards the
+// main averages.
+func updateAverages(s *Session, d time.Duration, rf recordFlag) bool {
+	set := getSettings()
+
+	if (rf&recordOutage != 0) && set.NoOutages {
+		return false
+	}
+
+	if rf&recordUncertain != 0 {
+		s.Uncertain.Update(d)
+		if !set.Uncertain {
+			return false
+		}
+	}
+
+	s.Total.Update(d)
+	if d > set.Short {
+		s.NoShort.Update(d)
+
+		if d < time.Duration(s.ShortestLong) {
+			s.ShortestLong = jsonDuration(d)
+		}
+	}
+
+	return true
 }
 
 // monitor connects to the census API, subscribes to PlayerLogin and
 // PlayerLogout events, and then sends them down the appropriate
-// channels.
-func monitor(logins chan<- *events.PlayerLogin, logouts chan<- *events.PlayerLogout, errors chan<- error) {
+// channels until ctx is canceled, at which point it closes them.
+func monitor(ctx context.Context, logins chan<- *events.PlayerLogin, logouts chan<- *events.PlayerLogout, errors chan<- error) {
+	defer close(logins)
+	defer close(logouts)
+	defer close(errors)
+
 	cl, err := events.NewClient("", "", "example")
 	if err != nil {
 		log.Fatalf("Failed to open client: %v", err)
 	}
-	defer cl.Close()
+
+	// Closing the client is the only way to interrupt Next.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+		cl.Close()
+	}()
 
 	err = cl.Subscribe(events.Sub{
 		Events: []string{"PlayerLogin", "PlayerLogout"},
@@ -148,41 +489,134 @@ func monitor(logins chan<- *events.PlayerLogin, logouts chan<- *events.PlayerLog
 	if err != nil {
 		log.Fatalf("Failed to subscribe to login/logout events: %v", err)
 	}
+	reportSubscribed()
 
 	for {
 		ev, err := cl.Next()
+		if ctx.Err() != nil {
+			return
+		}
 		if err != nil {
 			log.Printf("Error while fetching event: %v", err)
+			metricEventErrors.Inc()
+			reportEvent(err)
 			errors <- err
 			continue
 		}
+		reportEvent(nil)
 		errors <- nil
 
 		switch ev := ev.(type) {
 		case *events.PlayerLogin:
+			metricEvents.WithLabelValues("PlayerLogin").Inc()
 			logins <- ev
 		case *events.PlayerLogout:
+			metricEvents.WithLabelValues("PlayerLogout").Inc()
 			logouts <- ev
 		}
 	}
 }
 
 func main() {
+	if flag.NArg() > 0 {
+		err := runCommand(flag.Args())
+		if err != nil {
+			log.Fatalf("%v: %v", flag.Arg(0), err)
+		}
+		return
+	}
+
+	if flags.config != "" {
+		_, err := reloadSettings()
+		if err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+	}
+
+	db, err := createDB()
+	if err != nil {
+		log.Fatalf("Failed to create database: %v", err)
+	}
+
+	// Characters that were online when the tracker stopped may have
+	// logged out since then, so they can't be tracked anymore.
+	err = db.ClearChars()
+	if err != nil {
+		log.Fatalf("Failed to clear characters: %v", err)
+	}
+
+	profiles, err = createProfileCache(db)
+	if err != nil {
+		log.Fatalf("Failed to create profile cache: %v", err)
+	}
+
 	logins := make(chan *events.PlayerLogin)
 	logouts := make(chan *events.PlayerLogout)
 	errors := make(chan error)
 
-	go monitor(logins, logouts, errors)
-	go coord(logins, logouts, errors)
-	go server()
+	// The event stream is stopped separately from everything else so
+	// that coord keeps running until nothing else needs it.
+	monitorCtx, stopMonitor := context.WithCancel(context.Background())
+	defer stopMonitor()
+
+	coordDone := make(chan struct{})
+	go monitor(monitorCtx, logins, logouts, errors)
+	go func() {
+		defer close(coordDone)
+		coord(db, logins, logouts, errors)
+	}()
+
+	metricsDone := make(chan struct{})
+	go func() {
+		defer close(metricsDone)
+		onlineMetrics(profiles)
+	}()
+
+	srv := server(db)
 
-	cancel := make(chan struct{})
-	go autosave(cancel)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	sig := make(chan os.Signal)
-	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
-	log.Printf("Caught signal %q", <-sig)
+	var jobs sync.WaitGroup
+	for _, job := range []func(context.Context){
+		autosave,
+		func(ctx context.Context) { retain(ctx, db) },
+		func(ctx context.Context) { scheduleBackups(ctx, db) },
+	} {
+		jobs.Add(1)
+		go func(job func(context.Context)) {
+			defer jobs.Done()
+			job(ctx)
+		}(job)
+	}
+
+	<-ctx.Done()
+	stop()
+	log.Println("Shutting down...")
+
+	// Shut down the web interface first, as requests may need coord.
+	sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = srv.Shutdown(sctx)
+	if err != nil {
+		log.Printf("Failed to shut down server cleanly: %v", err)
+	}
 
-	cancel <- struct{}{}
-	<-cancel
+	// Wait for anything that's in progress, such as a backup, to
+	// finish before the database goes away.
+	jobs.Wait()
+
+	log.Println("Stopping event stream...")
+	stopMonitor()
+	<-coordDone
+
+	close(onlineUpdates)
+	<-metricsDone
+	profiles.Close()
+
+	log.Println("Closing database...")
+	err = db.Close()
+	if err != nil {
+		log.Printf("Failed to close database: %v", err)
+	}
 }
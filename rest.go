@@ -0,0 +1,497 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiPrefix is the path that version 1 of the REST API is served
+// under. The fields of the resources served under it are stable, so
+// they're deliberately kept separate from the internal types, such as
+// Session, that they're built from.
+const apiPrefix = "/api/v1/"
+
+// apiPageSize and apiMaxPageSize are the default and maximum number
+// of items in a single page of a paginated resource.
+const (
+	apiPageSize    = 50
+	apiMaxPageSize = 500
+)
+
+// apiDuration is a duration as represented by the API, both as a
+// number of seconds and as a human readable string.
+type apiDuration struct {
+	Seconds float64 `json:"seconds"`
+	Text    string  `json:"text"`
+}
+
+func newAPIDuration(d time.Duration) apiDuration {
+	return apiDuration{
+		Seconds: d.Seconds(),
+		Text:    d.String(),
+	}
+}
+
+// apiAverage is an average session length.
+type apiAverage struct {
+	Average  apiDuration `json:"average"`
+	Sessions int64       `json:"sessions"`
+}
+
+func newAPIAverage(r RollingAverage) apiAverage {
+	return apiAverage{
+		Average:  newAPIDuration(time.Duration(r.Cur)),
+		Sessions: r.Num,
+	}
+}
+
+// apiSession is a single character's session, either completed or
+// still active.
+type apiSession struct {
+	Duration apiDuration `json:"duration"`
+	Name     string      `json:"name"`
+}
+
+type apiStats struct {
+	Total     apiAverage `json:"total"`
+	NoShort   apiAverage `json:"no_short"`
+	Uncertain apiAverage `json:"uncertain"`
+
+	// ShortThreshold is the length below which a session is short.
+	ShortThreshold apiDuration `json:"short_threshold"`
+
+	Longest      apiSession  `json:"longest"`
+	OldestActive apiSession  `json:"oldest_active"`
+	Shortest     apiDuration `json:"shortest"`
+	ShortestLong apiDuration `json:"shortest_long"`
+
+	Online int `json:"online"`
+
+	Started    time.Time   `json:"started"`
+	Runtime    apiDuration `json:"runtime"`
+	EpochStart time.Time   `json:"epoch_start"`
+
+	Coverage       float64 `json:"coverage"`
+	GapSessions    int64   `json:"gap_sessions"`
+	Outages        int64   `json:"outages"`
+	OutageSessions int64   `json:"outage_sessions"`
+
+	Connected bool   `json:"connected"`
+	Error     string `json:"error,omitempty"`
+}
+
+type apiOnlineChar struct {
+	ID          int64       `json:"id"`
+	Name        string      `json:"name,omitempty"`
+	OutfitID    int64       `json:"outfit_id,omitempty"`
+	OutfitAlias string      `json:"outfit_alias,omitempty"`
+	Faction     int64       `json:"faction,omitempty"`
+	World       int64       `json:"world,omitempty"`
+	WorldName   string      `json:"world_name,omitempty"`
+	Login       time.Time   `json:"login"`
+	Elapsed     apiDuration `json:"elapsed"`
+}
+
+type apiCharacter struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	OutfitID    int64     `json:"outfit_id,omitempty"`
+	OutfitAlias string    `json:"outfit_alias,omitempty"`
+	Faction     int64     `json:"faction"`
+	World       int64     `json:"world"`
+	WorldName   string    `json:"world_name"`
+	BattleRank  int       `json:"battle_rank"`
+	Refreshed   time.Time `json:"refreshed"`
+
+	Online  bool         `json:"online"`
+	Login   *time.Time   `json:"login,omitempty"`
+	Elapsed *apiDuration `json:"elapsed,omitempty"`
+}
+
+type apiLeader struct {
+	Rank      int         `json:"rank"`
+	ID        int64       `json:"id"`
+	Name      string      `json:"name"`
+	World     int64       `json:"world"`
+	WorldName string      `json:"world_name"`
+	Duration  apiDuration `json:"duration"`
+	Logout    time.Time   `json:"logout"`
+}
+
+type apiWorld struct {
+	ID       int64       `json:"id"`
+	Name     string      `json:"name"`
+	Average  apiDuration `json:"average"`
+	Averaged int64       `json:"averaged"`
+	Sessions int64       `json:"sessions"`
+	Longest  apiDuration `json:"longest"`
+}
+
+// apiPage is a single page of a paginated resource.
+type apiPage struct {
+	Total  int         `json:"total"`
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+	Items  interface{} `json:"items"`
+}
+
+// apiErrorBody is the envelope that every error is sent in.
+type apiErrorBody struct {
+	Error struct {
+		Status  int    `json:"status"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// apiWrite writes v to rw as JSON with the given status code.
+func apiWrite(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(status)
+
+	e := json.NewEncoder(rw)
+	err := e.Encode(v)
+	if err != nil {
+		log.Printf("Failed to write API response: %v", err)
+	}
+}
+
+// apiError writes an error to rw in the error envelope.
+func apiError(rw http.ResponseWriter, status int, format string, args ...interface{}) {
+	var body apiErrorBody
+	body.Error.Status = status
+	body.Error.Message = fmt.Sprintf(format, args...)
+
+	apiWrite(rw, status, body)
+}
+
+// apiPagination returns the offset and limit given by the query
+// parameters of req.
+func apiPagination(req *http.Request) (offset, limit int, err error) {
+	limit = apiPageSize
+	if v := req.FormValue("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if (err != nil) || (limit <= 0) || (limit > apiMaxPageSize) {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %v", apiMaxPageSize)
+		}
+	}
+
+	if v := req.FormValue("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if (err != nil) || (offset < 0) {
+			return 0, 0, fmt.Errorf("offset must be a non-negative integer")
+		}
+	}
+
+	return offset, limit, nil
+}
+
+// apiStatsFrom builds the stats resource from s.
+func apiStatsFrom(s Session) apiStats {
+	stats := apiStats{
+		Total:     newAPIAverage(s.Total),
+		NoShort:   newAPIAverage(s.NoShort),
+		Uncertain: newAPIAverage(s.Uncertain),
+
+		ShortThreshold: newAPIDuration(getSettings().Short),
+
+		Longest: apiSession{
+			Duration: newAPIDuration(time.Duration(s.Longest)),
+			Name:     s.LongestName,
+		},
+
+		Online: s.NumChars,
+
+		Started:    time.Time(s.Runtime),
+		Runtime:    newAPIDuration(s.Runtime.Since()),
+		EpochStart: time.Unix(int64(s.EpochStart), 0),
+
+		Coverage:       s.Coverage,
+		GapSessions:    s.GapSessions,
+		Outages:        s.Outages,
+		OutageSessions: s.OutageSessions,
+
+		Connected: s.Err == nil,
+	}
+
+	if !time.Time(s.Oldest).IsZero() {
+		stats.OldestActive = apiSession{
+			Duration: newAPIDuration(s.Oldest.Since()),
+			Name:     s.OldestName,
+		}
+	}
+
+	// Shortest and ShortestLong start out as a placeholder that's
+	// longer than any real session.
+	if s.Total.Num > 0 {
+		stats.Shortest = newAPIDuration(time.Duration(s.Shortest))
+	}
+	if s.NoShort.Num > 0 {
+		stats.ShortestLong = newAPIDuration(time.Duration(s.ShortestLong))
+	}
+
+	if s.Err != nil {
+		stats.Error = s.Err.Error()
+	}
+
+	return stats
+}
+
+func apiWorldFrom(id int64, w *WorldStats) apiWorld {
+	return apiWorld{
+		ID:       id,
+		Name:     worldName(id),
+		Average:  newAPIDuration(time.Duration(w.Total.Cur)),
+		Averaged: w.Total.Num,
+		Sessions: w.Sessions,
+		Longest:  newAPIDuration(time.Duration(w.Longest)),
+	}
+}
+
+// serveAPI returns a handler that serves version 1 of the REST API.
+func serveAPI(db DB) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if (req.Method != "GET") && (req.Method != "HEAD") {
+			rw.Header().Set("Allow", "GET, HEAD")
+			apiError(rw, http.StatusMethodNotAllowed, "Method %v not allowed", req.Method)
+			return
+		}
+
+		path := strings.Trim(strings.TrimPrefix(req.URL.Path, apiPrefix), "/")
+		parts := strings.Split(path, "/")
+
+		switch {
+		case path == "":
+			apiWrite(rw, http.StatusOK, map[string]string{
+				"stats":             apiPrefix + "stats",
+				"online_characters": apiPrefix + "characters/online",
+				"character":         apiPrefix + "characters/{id}",
+				"leaderboards":      apiPrefix + "leaderboards",
+				"worlds":            apiPrefix + "worlds",
+				"world":             apiPrefix + "worlds/{id}",
+			})
+
+		case path == "stats":
+			apiWrite(rw, http.StatusOK, apiStatsFrom(<-session))
+
+		case path == "characters/online":
+			serveAPIOnline(db, rw, req)
+
+		case (len(parts) == 2) && (parts[0] == "characters"):
+			serveAPICharacter(db, rw, parts[1])
+
+		case path == "leaderboards":
+			serveAPILeaderboards(rw)
+
+		case path == "worlds":
+			s := <-session
+
+			list := make([]apiWorld, 0, len(s.Worlds))
+			for id, w := range s.Worlds {
+				list = append(list, apiWorldFrom(id, w))
+			}
+			sort.Slice(list, func(i, j int) bool {
+				return list[i].ID < list[j].ID
+			})
+
+			apiWrite(rw, http.StatusOK, list)
+
+		case (len(parts) == 2) && (parts[0] == "worlds"):
+			id, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil {
+				apiError(rw, http.StatusBadRequest, "Invalid world ID %q", parts[1])
+				return
+			}
+
+			w, ok := (<-session).Worlds[id]
+			if !ok {
+				apiError(rw, http.StatusNotFound, "No sessions have been recorded on world %v", id)
+				return
+			}
+
+			apiWrite(rw, http.StatusOK, apiWorldFrom(id, w))
+
+		default:
+			apiError(rw, http.StatusNotFound, "No such resource: %v", req.URL.Path)
+		}
+	})
+}
+
+// errPageFull is returned while going through the characters in the
+// DB to stop once a page is full.
+var errPageFull = errors.New("Page full")
+
+// serveAPIOnline serves a page of the currently online characters. By
+// default, they're sorted longest online first. The sort parameter can
+// be set to newest to sort them most recently logged in first instead.
+// Only the characters on the requested page are read from db, and
+// their profiles are looked up together. If the lookup fails, only the
+// characters whose profiles were already cached have names.
+func serveAPIOnline(db DB, rw http.ResponseWriter, req *http.Request) {
+	offset, limit, err := apiPagination(req)
+	if err != nil {
+		apiError(rw, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	var newest bool
+	switch v := req.FormValue("sort"); v {
+	case "", "longest":
+	case "newest":
+		newest = true
+	default:
+		apiError(rw, http.StatusBadRequest, "sort must be either longest or newest, not %q", v)
+		return
+	}
+
+	page := apiPage{
+		Total:  db.NumChar(),
+		Offset: offset,
+		Limit:  limit,
+	}
+
+	chars := []apiOnlineChar{}
+	var skipped int
+	err = db.EachCharByLogin(newest, func(id int64, login time.Time) error {
+		if skipped < offset {
+			skipped++
+			return nil
+		}
+
+		chars = append(chars, apiOnlineChar{ID: id, Login: login})
+		if len(chars) == limit {
+			return errPageFull
+		}
+		return nil
+	})
+	if (err != nil) && (err != errPageFull) {
+		log.Printf("Failed to get online characters: %v", err)
+		apiError(rw, http.StatusInternalServerError, "Failed to get online characters")
+		return
+	}
+
+	ids := make([]int64, 0, len(chars))
+	for _, c := range chars {
+		ids = append(ids, c.ID)
+	}
+	ps, err := getProfiles(ids)
+	if err != nil {
+		log.Printf("Failed to get profiles of online characters: %v", err)
+	}
+
+	now := time.Now()
+	for i := range chars {
+		c := &chars[i]
+		c.Elapsed = newAPIDuration(now.Sub(c.Login))
+
+		p, ok := ps[c.ID]
+		if !ok {
+			continue
+		}
+		c.Name = p.Name
+		c.OutfitID = p.OutfitID
+		c.OutfitAlias = p.OutfitAlias
+		c.Faction = p.Faction
+		c.World = p.World
+		c.WorldName = worldName(p.World)
+	}
+
+	page.Items = chars
+	apiWrite(rw, http.StatusOK, page)
+}
+
+// serveAPICharacter serves a single character's profile and online
+// status. Only characters that the tracker knows about, which are the
+// ones that are online or on the leaderboard, are served, so that
+// clients can't make the tracker look up and cache arbitrary IDs.
+func serveAPICharacter(db DB, rw http.ResponseWriter, v string) {
+	id, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		apiError(rw, http.StatusBadRequest, "Invalid character ID %q", v)
+		return
+	}
+
+	login, online, err := db.GetChar(id)
+	if err != nil {
+		log.Printf("Failed to get %v from DB: %v", id, err)
+		apiError(rw, http.StatusInternalServerError, "Failed to get online status of character %v", id)
+		return
+	}
+	if !online && !onLeaderboard(id) {
+		apiError(rw, http.StatusNotFound, "Character %v isn't online or on the leaderboard", id)
+		return
+	}
+
+	p, err := getProfile(id)
+	if err != nil {
+		if _, ok := err.(noSuchCharError); ok {
+			apiError(rw, http.StatusNotFound, "No such character: %v", id)
+			return
+		}
+
+		log.Printf("Failed to get profile of %v: %v", id, err)
+		apiError(rw, http.StatusBadGateway, "Failed to look up character %v", id)
+		return
+	}
+
+	c := apiCharacter{
+		ID:          p.ID,
+		Name:        p.Name,
+		OutfitID:    p.OutfitID,
+		OutfitAlias: p.OutfitAlias,
+		Faction:     p.Faction,
+		World:       p.World,
+		WorldName:   worldName(p.World),
+		BattleRank:  p.BattleRank,
+		Refreshed:   p.Refreshed,
+	}
+
+	if online {
+		elapsed := newAPIDuration(time.Since(login))
+		c.Online = true
+		c.Login = &login
+		c.Elapsed = &elapsed
+	}
+
+	apiWrite(rw, http.StatusOK, c)
+}
+
+// onLeaderboard returns true if the character with the given ID is on
+// the leaderboard of the current session.
+func onLeaderboard(id int64) bool {
+	for _, e := range (<-session).Leaderboard {
+		if e.CharID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serveAPILeaderboards serves the longest completed sessions.
+func serveAPILeaderboards(rw http.ResponseWriter) {
+	s := <-session
+
+	longest := make([]apiLeader, 0, len(s.Leaderboard))
+	for i, e := range s.Leaderboard {
+		longest = append(longest, apiLeader{
+			Rank:      i + 1,
+			ID:        e.CharID,
+			Name:      e.Name,
+			World:     e.World,
+			WorldName: worldName(e.World),
+			Duration:  newAPIDuration(time.Duration(e.Duration)),
+			Logout:    e.Logout,
+		})
+	}
+
+	apiWrite(rw, http.StatusOK, map[string]interface{}{
+		"longest_sessions": longest,
+	})
+}
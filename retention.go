@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rollupDayFormat is the format of Rollup.Day.
+const rollupDayFormat = "2006-01-02"
+
+// A Rollup summarizes the records from a single day on a single
+// world. When records are pruned, they're added to the rollups first,
+// so the rollups are kept forever.
+type Rollup struct {
+	// Day is the UTC day that the sessions ended on, formatted with
+	// rollupDayFormat.
+	Day   string `json:"day"`
+	World int64  `json:"world"`
+
+	Sessions int64        `json:"sessions"`
+	Total    jsonDuration `json:"total"`
+	Longest  jsonDuration `json:"longest"`
+}
+
+// Average returns the average length of the sessions in the rollup.
+func (r Rollup) Average() time.Duration {
+	if r.Sessions == 0 {
+		return 0
+	}
+
+	return time.Duration(int64(r.Total) / r.Sessions)
+}
+
+// Merge adds the sessions summarized by other to r.
+func (r *Rollup) Merge(other Rollup) {
+	r.Sessions += other.Sessions
+	r.Total += other.Total
+	if other.Longest > r.Longest {
+		r.Longest = other.Longest
+	}
+}
+
+// rollupDay returns the day of a rollup that a record with the given
+// logout time belongs to.
+func rollupDay(logout time.Time) string {
+	return logout.UTC().Format(rollupDayFormat)
+}
+
+type rollupKey struct {
+	day   string
+	world int64
+}
+
+// rollups collects records into rollups.
+type rollups map[rollupKey]*Rollup
+
+// Add adds a record to the rollup for its day and world.
+func (rs rollups) Add(r Record) {
+	k := rollupKey{day: rollupDay(r.Logout), world: r.World}
+
+	ru := rs[k]
+	if ru == nil {
+		ru = &Rollup{Day: k.day, World: k.world}
+		rs[k] = ru
+	}
+
+	ru.Merge(Rollup{Sessions: 1, Total: jsonDuration(r.Duration()), Longest: jsonDuration(r.Duration())})
+}
+
+// Merge merges r into the rollup for its day and world.
+func (rs rollups) Merge(r Rollup) {
+	k := rollupKey{day: r.Day, world: r.World}
+
+	ru := rs[k]
+	if ru == nil {
+		ru = &Rollup{Day: k.day, World: k.world}
+		rs[k] = ru
+	}
+
+	ru.Merge(r)
+}
+
+// A compacter is a DB that can reclaim unused space, such as space
+// left behind by pruning.
+type compacter interface {
+	// Compact compacts the database and returns the number of bytes
+	// reclaimed.
+	Compact() (int64, error)
+}
+
+// retentionResult is the result of a single run of the retention
+// job.
+type retentionResult struct {
+	Start    time.Time    `json:"start"`
+	Duration jsonDuration `json:"duration"`
+
+	// Records and Outages are the number of each that were pruned.
+	Records int `json:"records"`
+	Outages int `json:"outages"`
+
+	// Compacted is true if the database was compacted, and Reclaimed
+	// is the number of bytes that that reclaimed.
+	Compacted bool  `json:"compacted"`
+	Reclaimed int64 `json:"reclaimed"`
+
+	Err string `json:"err,omitempty"`
+}
+
+// retentionStatus keeps track of the retention job.
+var retentionStatus struct {
+	sync.Mutex
+
+	// running makes sure that only one run happens at a time.
+	running sync.Mutex
+
+	Running bool             `json:"running"`
+	Last    *retentionResult `json:"last"`
+}
+
+// retentionAge returns the maximum age of the kind of data given by
+// key from the -retain flag, or 0 if it should be kept forever.
+func retentionAge(key string) time.Duration {
+	v := flags.retain[key]
+	if v == "" {
+		return 0
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("Bad retention age for %q: %v", key, err)
+		return 0
+	}
+
+	return d
+}
+
+// runRetention prunes old data from db according to the -retain flag,
+// compacting it afterwards if compact is true and db supports it.
+func runRetention(db DB, compact bool) retentionResult {
+	retentionStatus.running.Lock()
+	defer retentionStatus.running.Unlock()
+
+	retentionStatus.Lock()
+	retentionStatus.Running = true
+	retentionStatus.Unlock()
+
+	res := retentionResult{Start: time.Now()}
+	defer func() {
+		res.Duration = jsonDuration(time.Since(res.Start))
+
+		retentionStatus.Lock()
+		retentionStatus.Running = false
+		retentionStatus.Last = &res
+		retentionStatus.Unlock()
+	}()
+
+	fail := func(err error) retentionResult {
+		log.Printf("Retention failed: %v", err)
+		res.Err = err.Error()
+		return res
+	}
+
+	if age := retentionAge("records"); age > 0 {
+		log.Printf("Pruning records older than %v...", age)
+
+		var err error
+		res.Records, err = db.PruneRecords(res.Start.Add(-age))
+		if err != nil {
+			return fail(err)
+		}
+		log.Printf("Pruned %v records.", res.Records)
+	}
+
+	if age := retentionAge("outages"); age > 0 {
+		log.Printf("Pruning outages older than %v...", age)
+
+		var err error
+		res.Outages, err = db.PruneOutages(res.Start.Add(-age))
+		if err != nil {
+			return fail(err)
+		}
+		log.Printf("Pruned %v outages.", res.Outages)
+	}
+
+	if c, ok := db.(compacter); compact && ok {
+		log.Println("Compacting database...")
+
+		var err error
+		res.Reclaimed, err = c.Compact()
+		if err != nil {
+			return fail(err)
+		}
+		res.Compacted = true
+		log.Printf("Compaction reclaimed %v bytes.", res.Reclaimed)
+	}
+
+	return res
+}
+
+// retain runs the retention job periodically, as configured by the
+// -retain flag, until ctx is canceled.
+func retain(ctx context.Context, db DB) {
+	every := retentionAge("every")
+	if every <= 0 {
+		return
+	}
+	compact, _ := strconv.ParseBool(flags.retain["compact"])
+
+	log.Printf("Running retention every %v.", every)
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			runRetention(db, compact)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// serveRetention returns a handler that serves the status of the
+// retention job as JSON. POST requests run the job immediately,
+// compacting the database if the compact parameter is true.
+func serveRetention(db DB) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET", "HEAD":
+		case "POST":
+			compact, _ := strconv.ParseBool(req.FormValue("compact"))
+			runRetention(db, compact)
+		default:
+			rw.Header().Set("Allow", "GET, HEAD, POST")
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		retentionStatus.Lock()
+		defer retentionStatus.Unlock()
+
+		e := json.NewEncoder(rw)
+		err := e.Encode(&retentionStatus)
+		if err != nil {
+			log.Printf("Failed to write retention status: %v", err)
+		}
+	})
+}
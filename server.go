@@ -1,100 +1,98 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
-	"io"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io/fs"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"text/template"
+	"time"
 )
 
-// serverTmpl stores templates for the web interface.
-var serverTmpl = new(template.Template)
+// serverTmpl stores the templates for the web interface that are
+// embedded in the binary. See templates.
+var serverTmpl = template.Must(parseTemplates(embeddedAssets()))
 
-func init() {
-	serverTmpl.Funcs(template.FuncMap{
-		"format": func(num int64, base int) string {
-			return strconv.FormatInt(num, base)
-		},
+// tmplFuncs are the functions available to the templates.
+var tmplFuncs = template.FuncMap{
+	"format": func(num int64, base int) string {
+		return strconv.FormatInt(num, base)
+	},
 
-		"shortlen": func() string {
-			return flags.short.String()
-		},
-	})
+	"shortlen": func() string {
+		return getSettings().Short.String()
+	},
 
-	template.Must(serverTmpl.New("main").Parse(`<html>
-	<head>
-		<title>{{.Title}} :: Main</title>
-		<script type='application/javascript' src='https://ajax.googleapis.com/ajax/libs/jquery/2.2.2/jquery.min.js' defer></script>
-		<script type='application/javascript' src='ps2avglogin.js' defer></script>
-
-		<style type='text/css'>
-			body
-			{
-				background-color:#EEEEEE;
-				font-family:Arial;
-			}
+	"warmup": func() string {
+		return getSettings().Warmup.String()
+	},
 
-			hr
-			{
-				width:80%;
-			}
+	"uncertain": func() bool {
+		return getSettings().Uncertain
+	},
 
-			#error
-			{
-				background-color:#EE0000;
+	"nooutages": func() bool {
+		return getSettings().NoOutages
+	},
+}
 
-				position:fixed;
-				top:0px;
-				left:0px;
-				right:0px;
+// templatePages are the assets that are templates, along with the
+// names that they're parsed as. They're only served by executing them,
+// never as is.
+var templatePages = []struct {
+	name string
+	file string
+}{
+	{"main", "index.html"},
+	{"online", "online.html"},
+	{"widget", "widget.html"},
+}
 
-				text-align:center;
-				padding:4px;
-				display:none;
-			}
-		</style>
-	</head>
-	<body>
-		<div id='error'></div>
-		<div style='max-width:800px;margin-left:auto;margin-right:auto;'>
-			<div id='loading'>
-				<h2>Loading...</h2>
-			</div>
-			<div id='main' style='display:none;'>
-				<div id='noshort'>
-					<h1>Excluding short sessions:</h1>
-					<h2>Average session: <span class='average'></span></h2>
-					<h3>Calculated from <span class='num'></span> sessions.</h3>
-					A session is short if it lasts less than {{shortlen}}.
-				</div>
-
-				<hr />
-
-				<div id='total'>
-					<h1>Including short sessions:</h1>
-					<h2>Average session: <span class='average'></span></h2>
-					<h3>Calculated from <span class='num'></span> sessions.</h3>
-				</div>
-
-				<hr />
-
-				<div>
-					<h2>Longest session: <span id='longest'></span> <span id='longestname'></span></h2>
-					<h2>Longest active session: <span id='oldest'></span> <span id='oldestname'></span></h2>
-					<h2>Shortest long session: <span id='shortestlong'></span></h2>
-					<h2>Shortest session: <span id='shortest'></span></h2>
-				</div>
-
-				<hr />
-
-				Currently tracking <span id='online'></span> active sessions.<br />
-				Tracker runtime: <span id='runtime'></span>
-			</div>
-		</div>
-	</body>
-</html>`))
+// isTemplate returns true if the asset with the given name is one of
+// templatePages.
+func isTemplate(name string) bool {
+	for _, page := range templatePages {
+		if page.file == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseTemplates parses the templates for the web interface from
+// fsys.
+func parseTemplates(fsys fs.FS) (*template.Template, error) {
+	t := template.New("").Funcs(tmplFuncs)
+
+	for _, page := range templatePages {
+		data, err := fs.ReadFile(fsys, page.file)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = t.New(page.name).Parse(string(data))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// templates returns the templates for the web interface. If assets
+// are being loaded from disk, they're parsed again every time so that
+// changes show up without restarting.
+func templates() (*template.Template, error) {
+	if flags.assets == "" {
+		return serverTmpl, nil
+	}
+
+	return parseTemplates(assetFS())
 }
 
 // logHandler returns an http.Handler that logs every request that
@@ -107,11 +105,21 @@ func logHandler(h http.Handler) http.Handler {
 	})
 }
 
-// tmplHandler returns a handler that serves the template t in
-// serverTmpl.
+// tmplHandler returns a handler that serves the template t. See
+// templates.
 func tmplHandler(t string) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-		err := serverTmpl.ExecuteTemplate(rw, t, map[string]interface{}{
+		tmpl, err := templates()
+		if err != nil {
+			log.Printf("Failed to load templates: %v", err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		rw.Header().Set("Cache-Control", "no-cache")
+
+		err = tmpl.ExecuteTemplate(rw, t, map[string]interface{}{
 			"Req":   req,
 			"Title": "PS2 Average Login Times",
 		})
@@ -130,92 +138,143 @@ func serveSession(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
-// serveJS serves the javascript for the web interface.
-func serveJS(rw http.ResponseWriter, req *http.Request) {
-	_, err := io.WriteString(rw, `$(document).ready(function() {
-	var loading = $('#loading');
-	var main = $('#main');
-
-	var noshort = {
-		"average": $('#noshort .average'),
-		"num": $('#noshort .num'),
-	};
-	var total = {
-		"average": $('#total .average'),
-		"num": $('#total .num'),
-	};
-
-	var longest = $('#longest');
-	var longestname = $('#longestname');
-	var shortestlong = $('#shortestlong');
-	var shortest = $('#shortest');
-
-	var oldest = $('#oldest');
-	var oldestname = $('#oldestname');
-
-	var online = $('#online');
-	var runtime = $('#runtime');
-
-	var error = $('#error');
-
-	function setFields(data)
-	{
-		loading.hide();
-		main.show();
-
-		noshort.average.html(data.noshort.cur);
-		noshort.num.html(data.noshort.num);
-		total.average.html(data.total.cur);
-		total.num.html(data.total.num);
-
-		longest.html(data.longest);
-		longestname.html('(' + data.longestname + ')');
-		shortestlong.html(data.shortestlong);
-		shortest.html(data.shortest);
-
-		oldest.html(data.oldest);
-		oldestname.html('(' + data.oldestname + ')');
-
-		online.html(data.numchars);
-		runtime.html(data.runtime);
-
-		if (data.err != undefined)
-		{
-			error.html('Error fetching data from Census API: ' + data.err);
-			error.slideDown('fast');
+// serveEpochs returns a handler that serves the archived epochs in
+// db, as well as the current session as an epoch, as JSON.
+func serveEpochs(db DB) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		epochs, err := db.Epochs()
+		if err != nil {
+			log.Printf("Failed to get epochs: %v", err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
 		}
-		else
-		{
-			error.slideUp('fast');
+
+		s := <-session
+		s.Err = nil
+
+		e := json.NewEncoder(rw)
+		err = e.Encode(map[string]interface{}{
+			"epochs": epochs,
+			"current": Epoch{
+				Start:   time.Unix(int64(s.EpochStart), 0),
+				End:     time.Now(),
+				Session: s,
+			},
+		})
+		if err != nil {
+			log.Printf("Failed to write epochs: %v", err)
 		}
+	})
+}
+
+// serveNewEpoch archives the current session under the label given
+// in the request and starts a new one.
+func serveNewEpoch(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		rw.Header().Set("Allow", "POST")
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	function getSession()
-	{
-		$.getJSON('session').done(setFields).fail(function() {
-			error.html('Error connecting to ps2avglogin server.');
-			error.slideDown('fast');
-		}).always(function() {
-			setTimeout(getSession, 30000);
-		});
-	};
-
-	getSession();
-});`)
+	err := newEpoch(req.FormValue("label"))
 	if err != nil {
-		log.Printf("Failed to write JS: %v", err)
+		log.Printf("Failed to start new epoch: %v", err)
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
 	}
+
+	rw.WriteHeader(http.StatusNoContent)
 }
 
-// server runs the web interface.
-func server() {
-	http.Handle("/session", logHandler(http.HandlerFunc(serveSession)))
-	http.Handle("/ps2avglogin.js", logHandler(http.HandlerFunc(serveJS)))
-	http.Handle("/", logHandler(tmplHandler("main")))
+// adminAuthorized returns true if req carries either the admin token
+// given by the -admin flag or the basic auth credentials given by the
+// -adminuser flag.
+func adminAuthorized(req *http.Request) bool {
+	if flags.admin != "" {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(flags.admin)) == 1 {
+			return true
+		}
+	}
 
-	log.Printf("Starting server at %q...", flags.addr)
-	err := http.ListenAndServe(flags.addr, nil)
-	if err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	if flags.adminuser != "" {
+		user, pass, ok := req.BasicAuth()
+		if ok && (subtle.ConstantTimeCompare([]byte(user+":"+pass), []byte(flags.adminuser)) == 1) {
+			return true
+		}
 	}
+
+	return false
+}
+
+// adminHandler returns an http.Handler that only passes requests on
+// to h if they're authorized by adminAuthorized.
+func adminHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if (flags.admin == "") && (flags.adminuser == "") {
+			http.Error(rw, "Admin endpoints are disabled", http.StatusForbidden)
+			return
+		}
+
+		if !adminAuthorized(req) {
+			if flags.admin != "" {
+				rw.Header().Add("WWW-Authenticate", "Bearer")
+			}
+			if flags.adminuser != "" {
+				rw.Header().Add("WWW-Authenticate", `Basic realm="ps2avglogin admin"`)
+			}
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(rw, req)
+	})
+}
+
+// server starts the web interface. The returned server can be used
+// to shut it down.
+func server(db DB) *http.Server {
+	http.Handle("/session", logHandler(http.HandlerFunc(serveSession)))
+	http.Handle("/live", logHandler(http.HandlerFunc(serveLive)))
+	http.Handle("/epochs", logHandler(serveEpochs(db)))
+	http.Handle("/outages", logHandler(serveOutages(db)))
+	http.Handle("/coverage", logHandler(serveCoverage(db)))
+	http.Handle("/survival", logHandler(serveSurvival(db)))
+	http.Handle("/survival/remaining", logHandler(serveRemaining(db)))
+	http.Handle(apiPrefix, logHandler(serveAPI(db)))
+	http.Handle("/export/sessions", logHandler(serveExportSessions(db)))
+	http.Handle("/export/rollups", logHandler(serveExportRollups(db)))
+	http.Handle("/export/online", logHandler(serveExportOnline(db)))
+	http.Handle("/admin/epoch", logHandler(adminHandler(http.HandlerFunc(serveNewEpoch))))
+	http.Handle("/admin/retention", logHandler(adminHandler(serveRetention(db))))
+	http.Handle("/admin/backup", logHandler(adminHandler(serveBackup(db))))
+	http.Handle("/admin/save", logHandler(adminHandler(http.HandlerFunc(serveAdminSave))))
+	http.Handle("/admin/reset", logHandler(adminHandler(http.HandlerFunc(serveAdminReset))))
+	http.Handle("/admin/reload", logHandler(adminHandler(http.HandlerFunc(serveAdminReload))))
+	http.Handle("/admin/evict", logHandler(adminHandler(http.HandlerFunc(serveAdminEvict))))
+	http.Handle("/admin/profiles/refresh", logHandler(adminHandler(http.HandlerFunc(serveAdminRefresh))))
+	http.Handle("/admin/queues", logHandler(adminHandler(http.HandlerFunc(serveAdminQueues))))
+	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/healthz", http.HandlerFunc(serveHealthz))
+	http.Handle("/readyz", serveReadyz(db))
+	http.Handle("/online", logHandler(tmplHandler("online")))
+	http.Handle("/badge/", serveBadge(db))
+	http.Handle("/widget", serveWidget(db))
+	http.Handle("/", logHandler(serveRoot(tmplHandler("main"))))
+
+	srv := &http.Server{Addr: flags.addr}
+
+	// Live clients never go idle on their own, so they have to be
+	// told to disconnect for a shutdown to finish.
+	srv.RegisterOnShutdown(live.CloseAll)
+
+	go func() {
+		log.Printf("Starting server at %q...", flags.addr)
+		err := srv.ListenAndServe()
+		if err != http.ErrServerClosed {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
+	return srv
 }
@@ -2,7 +2,11 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
 	"log"
+	"sort"
 	"time"
 )
 
@@ -13,9 +17,13 @@ type Session struct {
 	Total RollingAverage `json:"total"`
 
 	// NoShort is an average that excludes 'short' sessions. See
-	// flags.short.
+	// settings.Short.
 	NoShort RollingAverage `json:"noshort"`
 
+	// Uncertain is an average of only the uncertain sessions, such as
+	// those that started during the warm-up period. See settings.Warmup.
+	Uncertain RollingAverage `json:"uncertain"`
+
 	// Longest and Shortest are the longest and shortest sessions that
 	// have completed this session, respectively.
 	//
@@ -27,6 +35,13 @@ type Session struct {
 	ShortestLong jsonDuration `json:"shortestlong"`
 	Shortest     jsonDuration `json:"shortest"`
 
+	// Leaderboard is the longest sessions that have completed this
+	// session, longest first. It holds at most leaderboardSize entries.
+	Leaderboard []LeaderboardEntry `json:"leaderboard"`
+
+	// Worlds holds statistics for each world, keyed by world ID.
+	Worlds map[int64]*WorldStats `json:"worlds"`
+
 	Oldest     timeDiff `json:"oldest" walk:"-"`
 	OldestName string   `json:"oldestname" walk:"-"`
 
@@ -36,10 +51,32 @@ type Session struct {
 	// timeDiff is a wrapper around time.Time.
 	Runtime timeDiff `json:"runtime" walk:"-"`
 
+	// EpochStart is the time that the current epoch was started. When
+	// an epoch is archived, a new session is started in its place.
+	EpochStart unixTime `json:"epochstart"`
+
+	// Coverage is the percentage of the time since the tracker was
+	// first run that it has been connected.
+	Coverage float64 `json:"coverage" walk:"-"`
+
+	// GapSessions is the number of completed sessions that overlapped
+	// a period during which the tracker was disconnected. Their lengths
+	// are untrustworthy.
+	GapSessions int64 `json:"gapsessions"`
+
+	// Outages is the number of outages that have been detected, and
+	// OutageSessions is the number of sessions that they ended.
+	Outages        int64 `json:"outages"`
+	OutageSessions int64 `json:"outagesessions"`
+
 	// NumChars is the number of online characters that are currently
 	// being tracked.
 	NumChars int `json:"numchars"`
 
+	// Recovered is the backup that the session was recovered from if
+	// the main copy couldn't be loaded.
+	Recovered string `json:"recovered,omitempty"`
+
 	// Err is holds any errors encountered by the monitor.
 	Err error `json:"err,omitempty" walk:"-"`
 
@@ -48,25 +85,194 @@ type Session struct {
 	db DB
 }
 
-func (s Session) Save() error {
-	return s.db.SaveSession(s)
+// leaderboardSize is the maximum number of entries in
+// Session.Leaderboard.
+const leaderboardSize = 10
+
+// A LeaderboardEntry is a single completed session on the leaderboard.
+type LeaderboardEntry struct {
+	CharID   int64        `json:"id"`
+	Name     string       `json:"name"`
+	World    int64        `json:"world"`
+	Duration jsonDuration `json:"duration"`
+	Logout   time.Time    `json:"logout"`
 }
 
-func autosave(cancel chan struct{}) {
-	defer func() {
-		log.Println("Saving session...")
-		err := (<-session).Save()
-		if err != nil {
-			log.Printf("Failed to save session: %v", err)
-		}
+// WorldStats are the statistics of the sessions on a single world.
+type WorldStats struct {
+	// Total is the average of the sessions that counted towards
+	// Session.Total.
+	Total RollingAverage `json:"total"`
+
+	// Sessions is the number of completed sessions, including ones
+	// that didn't count towards the average.
+	Sessions int64 `json:"sessions"`
+
+	Longest jsonDuration `json:"longest"`
+}
+
+// qualifies returns true if a session that lasted for d would make it
+// onto the leaderboard.
+func (s *Session) qualifies(d time.Duration) bool {
+	n := len(s.Leaderboard)
+	return (n < leaderboardSize) || (d > time.Duration(s.Leaderboard[n-1].Duration))
+}
+
+// addLeader adds an entry to the leaderboard, if it qualifies,
+// keeping it sorted and dropping the shortest entry if it's full.
+func (s *Session) addLeader(e LeaderboardEntry) {
+	if !s.qualifies(time.Duration(e.Duration)) {
+		return
+	}
+
+	i := sort.Search(len(s.Leaderboard), func(i int) bool {
+		return s.Leaderboard[i].Duration < e.Duration
+	})
+	s.Leaderboard = append(s.Leaderboard, LeaderboardEntry{})
+	copy(s.Leaderboard[i+1:], s.Leaderboard[i:])
+	s.Leaderboard[i] = e
+
+	if len(s.Leaderboard) > leaderboardSize {
+		s.Leaderboard = s.Leaderboard[:leaderboardSize]
+	}
+}
+
+// namedChars returns the IDs of the characters whose names are stored
+// in s, which are those on the leaderboard and oldest, the character
+// with the oldest active session.
+func (s *Session) namedChars(oldest int64) []int64 {
+	ids := make([]int64, 0, len(s.Leaderboard)+1)
+	if oldest != 0 {
+		ids = append(ids, oldest)
+	}
+	for _, e := range s.Leaderboard {
+		ids = append(ids, e.CharID)
+	}
+
+	return ids
+}
+
+// world returns the statistics for the world with the given ID,
+// creating them if necessary.
+func (s *Session) world(id int64) *WorldStats {
+	if s.Worlds == nil {
+		s.Worlds = make(map[int64]*WorldStats)
+	}
+
+	w := s.Worlds[id]
+	if w == nil {
+		w = new(WorldStats)
+		s.Worlds[id] = w
+	}
+
+	return w
+}
+
+// clone returns a copy of s that doesn't share any mutable state with
+// it, so that it can be used safely while s is still being updated.
+func (s Session) clone() Session {
+	s.Leaderboard = append([]LeaderboardEntry(nil), s.Leaderboard...)
+
+	worlds := make(map[int64]*WorldStats, len(s.Worlds))
+	for id, w := range s.Worlds {
+		w := *w
+		worlds[id] = &w
+	}
+	s.Worlds = worlds
+
+	return s
+}
+
+// initSession fills in the defaults for any fields of s that haven't
+// been set yet.
+func initSession(s *Session) {
+	if s.ShortestLong == 0 {
+		s.ShortestLong = jsonDuration(1000 * time.Hour)
+	}
+	if s.Shortest == 0 {
+		s.Shortest = jsonDuration(1000 * time.Hour)
+	}
+	if s.EpochStart == 0 {
+		s.EpochStart = unixTime(time.Now().Unix())
+	}
+}
+
+// sessionVersion is the version of the format that sessions are
+// stored in by marshalSession. It must be incremented whenever a
+// change to Session would cause an older stored session to be loaded
+// incorrectly, and unmarshalSession must be updated to convert the
+// older version.
+const sessionVersion = 1
 
-		close(cancel)
-	}()
+// storedSession is the format that sessions are stored in.
+type storedSession struct {
+	Version int             `json:"version"`
+	Session json.RawMessage `json:"session"`
+}
+
+// marshalSession encodes s into the format that databases store it
+// in.
+func marshalSession(s Session) ([]byte, error) {
+	s.Err = nil
+	s.Recovered = ""
 
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(storedSession{
+		Version: sessionVersion,
+		Session: data,
+	})
+}
+
+// unmarshalSession decodes a session encoded by marshalSession,
+// converting it from older versions if necessary.
+func unmarshalSession(data []byte) (s Session, err error) {
+	var stored storedSession
+	err = json.Unmarshal(data, &stored)
+	if err != nil {
+		return s, err
+	}
+
+	switch stored.Version {
+	case 0:
+		// Before the format was versioned, the session was stored
+		// directly.
+		err = json.Unmarshal(data, &s)
+
+	case 1:
+		err = json.Unmarshal(stored.Session, &s)
+
+	default:
+		return s, fmt.Errorf("Stored session version %v is newer than the latest known version %v", stored.Version, sessionVersion)
+	}
+
+	return s, err
+}
+
+func (s Session) Save() error {
+	defer observeDB("save_session")()
+
+	err := s.db.SaveSession(s)
+	if err == nil {
+		metricLastSave.SetToCurrentTime()
+	}
+
+	return err
+}
+
+// autosave saves the session periodically until ctx is canceled. The
+// final save is left to coord, as events may still be arriving when
+// ctx is canceled.
+func autosave(ctx context.Context) {
 	var tick <-chan time.Time
 	if flags.autosave > 0 {
 		log.Printf("Autosaving every %v.", flags.autosave)
-		tick = time.Tick(flags.autosave)
+		t := time.NewTicker(flags.autosave)
+		defer t.Stop()
+		tick = t.C
 	}
 
 	for {
@@ -74,11 +280,15 @@ func autosave(cancel chan struct{}) {
 		case <-tick:
 			log.Printf("Autosaving session...")
 			err := (<-session).Save()
+			reportSave(err)
 			if err != nil {
 				log.Printf("Error autosaving session: %v", err)
+				metricAutosaves.WithLabelValues("failure").Inc()
+				break
 			}
+			metricAutosaves.WithLabelValues("success").Inc()
 
-		case <-cancel:
+		case <-ctx.Done():
 			return
 		}
 	}
@@ -118,6 +328,11 @@ func (t timeDiff) MarshalJSON() ([]byte, error) {
 
 func (t *timeDiff) UnmarshalJSON(data []byte) error {
 	data = bytes.Trim(data, `"`)
+	if string(data) == "None" {
+		*t = timeDiff{}
+		return nil
+	}
+
 	d, err := time.ParseDuration(string(data))
 	if err != nil {
 		return err
@@ -127,3 +342,43 @@ func (t *timeDiff) UnmarshalJSON(data []byte) error {
 
 	return nil
 }
+
+// unixTime is a Unix timestamp in seconds. It marshals to JSON as an
+// RFC 3339 timestamp.
+type unixTime int64
+
+func (t unixTime) String() string {
+	if t == 0 {
+		return "None"
+	}
+
+	return time.Unix(int64(t), 0).Format(time.RFC3339)
+}
+
+func (t unixTime) MarshalJSON() ([]byte, error) {
+	str := t.String()
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(str)+2))
+	buf.WriteByte('"')
+	buf.WriteString(str)
+	buf.WriteByte('"')
+
+	return buf.Bytes(), nil
+}
+
+func (t *unixTime) UnmarshalJSON(data []byte) error {
+	data = bytes.Trim(data, `"`)
+	if string(data) == "None" {
+		*t = 0
+		return nil
+	}
+
+	p, err := time.Parse(time.RFC3339, string(data))
+	if err != nil {
+		return err
+	}
+
+	*t = unixTime(p.Unix())
+
+	return nil
+}
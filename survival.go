@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// survivalResolution is the resolution that session lengths are
+// truncated to before the survival curve is estimated. This keeps
+// the number of points on the curve manageable.
+const survivalResolution = time.Minute
+
+// survivalCacheTime is how long an estimated survival curve is reused
+// before a new one is calculated.
+const survivalCacheTime = time.Minute
+
+// A SurvivalPoint is a single step of a survival curve. Survival is
+// the estimated probability that a session lasts longer than Time.
+type SurvivalPoint struct {
+	Time     jsonDuration `json:"time"`
+	Survival float64      `json:"survival"`
+}
+
+// A Survival is a Kaplan-Meier estimate of the distribution of
+// session lengths. Unlike the averages in Session, it takes sessions
+// that are still in progress into account, so long sessions are not
+// under-represented just because they haven't ended yet.
+type Survival struct {
+	// Median is the estimated median session length. It is nil if
+	// less than half of the sessions are known to have ended.
+	Median *jsonDuration `json:"median"`
+
+	// Completed and Active are the number of completed and in-progress
+	// sessions that the estimate was calculated from.
+	Completed int `json:"completed"`
+	Active    int `json:"active"`
+
+	// Curve is the estimated survival function. It's a step function,
+	// so the survival at any given time is that of the last point at
+	// or before it.
+	Curve []SurvivalPoint `json:"curve"`
+
+	// area[i] is the area under the curve from Curve[i].Time to the
+	// last point.
+	area []float64
+}
+
+// observation is a single session length. If censored is true, the
+// session hasn't ended yet, so it's only known to be at least d long.
+type observation struct {
+	d        time.Duration
+	censored bool
+}
+
+// kaplanMeier estimates the survival function from obs. obs is sorted
+// in the process.
+func kaplanMeier(obs []observation) *Survival {
+	sort.Slice(obs, func(i1, i2 int) bool {
+		if obs[i1].d != obs[i2].d {
+			return obs[i1].d < obs[i2].d
+		}
+
+		// Ends are considered to happen before censoring at the same
+		// time.
+		return !obs[i1].censored && obs[i2].censored
+	})
+
+	sv := &Survival{
+		Curve: []SurvivalPoint{{Time: 0, Survival: 1}},
+	}
+
+	s := 1.0
+	atRisk := len(obs)
+	for i := 0; i < len(obs); {
+		d := obs[i].d
+
+		var ended, censored int
+		for ; (i < len(obs)) && (obs[i].d == d); i++ {
+			if obs[i].censored {
+				censored++
+				continue
+			}
+			ended++
+		}
+
+		sv.Completed += ended
+		sv.Active += censored
+
+		if ended > 0 {
+			s *= 1 - float64(ended)/float64(atRisk)
+			sv.Curve = append(sv.Curve, SurvivalPoint{Time: jsonDuration(d), Survival: s})
+
+			if (sv.Median == nil) && (s <= 0.5) {
+				median := jsonDuration(d)
+				sv.Median = &median
+			}
+		}
+
+		atRisk -= ended + censored
+	}
+
+	sv.area = make([]float64, len(sv.Curve))
+	for i := len(sv.Curve) - 2; i >= 0; i-- {
+		width := time.Duration(sv.Curve[i+1].Time - sv.Curve[i].Time).Seconds()
+		sv.area[i] = sv.area[i+1] + width*sv.Curve[i].Survival
+	}
+
+	return sv
+}
+
+// at returns the index of the last point on the curve at or before
+// d.
+func (sv *Survival) at(d time.Duration) int {
+	if d < 0 {
+		return 0
+	}
+
+	return sort.Search(len(sv.Curve), func(i int) bool {
+		return time.Duration(sv.Curve[i].Time) > d
+	}) - 1
+}
+
+// Remaining returns the expected remaining length of a session that
+// has already lasted for d. Because nothing is known about sessions
+// longer than the longest completed one, the expectation is
+// restricted to that length.
+func (sv *Survival) Remaining(d time.Duration) time.Duration {
+	if d < 0 {
+		d = 0
+	}
+
+	i := sv.at(d)
+	p := sv.Curve[i]
+	if p.Survival == 0 {
+		return 0
+	}
+
+	area := sv.area[i]
+	if i+1 < len(sv.Curve) {
+		// Remove the part of the first step that's already passed.
+		area -= (d - time.Duration(p.Time)).Seconds() * p.Survival
+	} else {
+		area = 0
+	}
+
+	return time.Duration(area / p.Survival * float64(time.Second))
+}
+
+// survivalCache caches the survival curve so that it isn't
+// recalculated for every request.
+var survivalCache struct {
+	sync.Mutex
+	sv   *Survival
+	when time.Time
+}
+
+// getSurvival returns an estimate of the survival curve from the
+// completed and active sessions in db, calculating a new one if the
+// cached one is too old.
+func getSurvival(db DB) (*Survival, error) {
+	survivalCache.Lock()
+	defer survivalCache.Unlock()
+
+	if (survivalCache.sv != nil) && (time.Since(survivalCache.when) < survivalCacheTime) {
+		return survivalCache.sv, nil
+	}
+
+	var obs []observation
+	err := db.EachRecord(func(r Record) error {
+		obs = append(obs, observation{d: r.Duration().Truncate(survivalResolution)})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	err = db.EachChar(func(id int64, login time.Time) error {
+		obs = append(obs, observation{d: now.Sub(login).Truncate(survivalResolution), censored: true})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	survivalCache.sv = kaplanMeier(obs)
+	survivalCache.when = now
+
+	return survivalCache.sv, nil
+}
+
+// serveSurvival returns a handler that serves the estimated survival
+// curve as JSON.
+func serveSurvival(db DB) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		sv, err := getSurvival(db)
+		if err != nil {
+			log.Printf("Failed to estimate survival curve: %v", err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		e := json.NewEncoder(rw)
+		err = e.Encode(sv)
+		if err != nil {
+			log.Printf("Failed to write survival curve: %v", err)
+		}
+	})
+}
+
+// serveRemaining returns a handler that serves the expected remaining
+// session length of every tracked character as JSON.
+func serveRemaining(db DB) http.Handler {
+	type remaining struct {
+		ID        int64        `json:"id"`
+		Elapsed   jsonDuration `json:"elapsed"`
+		Remaining jsonDuration `json:"remaining"`
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		sv, err := getSurvival(db)
+		if err != nil {
+			log.Printf("Failed to estimate survival curve: %v", err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		now := time.Now()
+		chars := make([]remaining, 0, db.NumChar())
+		err = db.EachChar(func(id int64, login time.Time) error {
+			elapsed := now.Sub(login)
+			chars = append(chars, remaining{
+				ID:        id,
+				Elapsed:   jsonDuration(elapsed.Truncate(time.Second)),
+				Remaining: jsonDuration(sv.Remaining(elapsed).Truncate(time.Second)),
+			})
+			return nil
+		})
+		if err != nil {
+			log.Printf("Failed to get active characters: %v", err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sort.Slice(chars, func(i1, i2 int) bool {
+			return chars[i1].Elapsed > chars[i2].Elapsed
+		})
+
+		e := json.NewEncoder(rw)
+		err = e.Encode(chars)
+		if err != nil {
+			log.Printf("Failed to write remaining times: %v", err)
+		}
+	})
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// writeBehindDB wraps a sqliteDB, buffering changes to characters in
+// memory and writing them to the database in periodic transactions
+// instead of one at a time. Reads of characters check the buffer
+// before the database, so they always see the latest changes without
+// having to write anything first.
+type writeBehindDB struct {
+	*sqliteDB
+
+	// max is the number of buffered changes at which the buffer is
+	// flushed immediately instead of waiting for the next tick.
+	max int
+
+	m sync.Mutex
+
+	// pending holds changes that haven't been written yet, and
+	// flushing holds the changes that are currently being written. A
+	// nil login time means that the character was removed.
+	pending  map[int64]*time.Time
+	flushing map[int64]*time.Time
+
+	// num is the number of characters, including pending changes.
+	num int
+
+	// flushM makes sure that only one flush happens at a time.
+	flushM sync.Mutex
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newwriteBehindDB wraps db, flushing changes every interval or
+// whenever max changes are buffered.
+func newwriteBehindDB(db *sqliteDB, interval time.Duration, max int) *writeBehindDB {
+	wb := &writeBehindDB{
+		sqliteDB: db,
+		max:      max,
+		pending:  make(map[int64]*time.Time),
+		num:      db.NumChar(),
+		done:     make(chan struct{}),
+	}
+
+	wb.wg.Add(1)
+	go func() {
+		defer wb.wg.Done()
+
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+
+		for {
+			select {
+			case <-tick.C:
+				err := wb.Flush()
+				if err != nil {
+					log.Printf("Failed to flush characters to DB: %v", err)
+				}
+
+			case <-wb.done:
+				return
+			}
+		}
+	}()
+
+	return wb
+}
+
+// lookup returns the login time of a character, checking the buffers
+// before the database. It must be called with wb.m held.
+func (wb *writeBehindDB) lookup(id int64) (time.Time, bool, error) {
+	for _, buf := range []map[int64]*time.Time{wb.pending, wb.flushing} {
+		if login, ok := buf[id]; ok {
+			if login == nil {
+				return time.Time{}, false, nil
+			}
+			return *login, true, nil
+		}
+	}
+
+	return wb.sqliteDB.GetChar(id)
+}
+
+// set buffers a change to a character, flushing if the buffer is
+// full.
+func (wb *writeBehindDB) set(id int64, login *time.Time) error {
+	wb.m.Lock()
+	_, exists, err := wb.lookup(id)
+	if err != nil {
+		wb.m.Unlock()
+		return err
+	}
+
+	switch {
+	case exists && (login == nil):
+		wb.num--
+	case !exists && (login != nil):
+		wb.num++
+	}
+
+	wb.pending[id] = login
+	full := len(wb.pending) >= wb.max
+	wb.m.Unlock()
+
+	if full {
+		return wb.Flush()
+	}
+
+	return nil
+}
+
+func (wb *writeBehindDB) SetChar(id int64, login time.Time) error {
+	return wb.set(id, &login)
+}
+
+func (wb *writeBehindDB) GetChar(id int64) (time.Time, bool, error) {
+	wb.m.Lock()
+	defer wb.m.Unlock()
+
+	return wb.lookup(id)
+}
+
+// overlay returns a copy of the buffered changes, with pending changes
+// taking precedence over those being written, so that the database can
+// be read with them on top without holding wb.m.
+func (wb *writeBehindDB) overlay() map[int64]*time.Time {
+	wb.m.Lock()
+	defer wb.m.Unlock()
+
+	o := make(map[int64]*time.Time, len(wb.pending)+len(wb.flushing))
+	for id, login := range wb.flushing {
+		o[id] = login
+	}
+	for id, login := range wb.pending {
+		o[id] = login
+	}
+
+	return o
+}
+
+// errOldestFound is returned while going through the characters to
+// stop once OldestChar has found the oldest one.
+var errOldestFound = errors.New("Oldest character found")
+
+func (wb *writeBehindDB) OldestChar() (id int64, login time.Time, err error) {
+	err = wb.EachCharByLogin(false, func(i int64, l time.Time) error {
+		id, login = i, l
+		return errOldestFound
+	})
+	if err == errOldestFound {
+		err = nil
+	}
+
+	return id, login, err
+}
+
+func (wb *writeBehindDB) RemoveChar(id int64) error {
+	return wb.set(id, nil)
+}
+
+func (wb *writeBehindDB) ClearChars() error {
+	wb.flushM.Lock()
+	defer wb.flushM.Unlock()
+
+	wb.m.Lock()
+	defer wb.m.Unlock()
+
+	err := wb.sqliteDB.ClearChars()
+	if err != nil {
+		return err
+	}
+
+	wb.pending = make(map[int64]*time.Time)
+	wb.num = 0
+	return nil
+}
+
+func (wb *writeBehindDB) NumChar() int {
+	wb.m.Lock()
+	defer wb.m.Unlock()
+
+	return wb.num
+}
+
+func (wb *writeBehindDB) EachChar(f func(int64, time.Time) error) error {
+	o := wb.overlay()
+
+	err := wb.sqliteDB.EachChar(func(id int64, login time.Time) error {
+		if _, ok := o[id]; ok {
+			return nil
+		}
+		return f(id, login)
+	})
+	if err != nil {
+		return err
+	}
+
+	for id, login := range o {
+		if login == nil {
+			continue
+		}
+
+		err := f(id, *login)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// EachCharByLogin merges the buffered characters, sorted the same way,
+// into the ones read from the database.
+func (wb *writeBehindDB) EachCharByLogin(newest bool, f func(int64, time.Time) error) error {
+	type char struct {
+		id    int64
+		login time.Time
+	}
+	before := func(a, b char) bool {
+		if !a.login.Equal(b.login) {
+			return a.login.Before(b.login) != newest
+		}
+		return (a.id < b.id) != newest
+	}
+
+	o := wb.overlay()
+	buf := make([]char, 0, len(o))
+	for id, login := range o {
+		if login != nil {
+			buf = append(buf, char{id: id, login: *login})
+		}
+	}
+	sort.Slice(buf, func(i, j int) bool {
+		return before(buf[i], buf[j])
+	})
+
+	err := wb.sqliteDB.EachCharByLogin(newest, func(id int64, login time.Time) error {
+		if _, ok := o[id]; ok {
+			return nil
+		}
+
+		c := char{id: id, login: login}
+		for (len(buf) > 0) && before(buf[0], c) {
+			err := f(buf[0].id, buf[0].login)
+			if err != nil {
+				return err
+			}
+			buf = buf[1:]
+		}
+
+		return f(id, login)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, c := range buf {
+		err := f(c.id, c.login)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Pending returns the number of buffered changes that haven't been
+// written yet, including those being written right now.
+func (wb *writeBehindDB) Pending() int {
+	wb.m.Lock()
+	defer wb.m.Unlock()
+
+	return len(wb.pending) + len(wb.flushing)
+}
+
+// Flush writes all buffered changes to the database in a single
+// transaction. If the write fails, the changes are kept so that they
+// can be retried.
+func (wb *writeBehindDB) Flush() error {
+	wb.flushM.Lock()
+	defer wb.flushM.Unlock()
+
+	wb.m.Lock()
+	if len(wb.pending) == 0 {
+		wb.m.Unlock()
+		return nil
+	}
+	batch := wb.pending
+	wb.pending = make(map[int64]*time.Time)
+	wb.flushing = batch
+	wb.m.Unlock()
+
+	err := wb.write(batch)
+
+	wb.m.Lock()
+	defer wb.m.Unlock()
+
+	wb.flushing = nil
+	if err != nil {
+		// Put the batch back without overwriting anything newer.
+		for id, login := range batch {
+			if _, ok := wb.pending[id]; !ok {
+				wb.pending[id] = login
+			}
+		}
+	}
+
+	return err
+}
+
+// write writes a batch of changes to the database.
+func (wb *writeBehindDB) write(batch map[int64]*time.Time) error {
+	tx, err := wb.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	add := tx.Stmt(wb.add)
+	rem := tx.Stmt(wb.rem)
+	for id, login := range batch {
+		if login == nil {
+			_, err = rem.Exec(id)
+		} else {
+			_, err = add.Exec(id, *login)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Close flushes any buffered changes and closes the database.
+func (wb *writeBehindDB) Close() error {
+	close(wb.done)
+	wb.wg.Wait()
+
+	err := wb.Flush()
+	if err != nil {
+		log.Printf("Failed to flush characters to DB: %v", err)
+	}
+
+	return wb.sqliteDB.Close()
+}